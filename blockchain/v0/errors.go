@@ -0,0 +1,92 @@
+package v0
+
+import (
+	"fmt"
+	"strings"
+
+	tmbytes "github.com/tendermint/tendermint/libs/bytes"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ErrConflictingBlocks is reported when two peers deliver different blocks
+// for the same height, neither of which was rejected (see
+// BlockPool.RedoRequest). At least one of them is lying about the chain, so
+// this is a strong equivocation signal. As it's unknown which one, it's sent
+// on errorsCh without a peer ID, so no peer is disconnected for it.
+type ErrConflictingBlocks struct {
+	Height     int64
+	FirstPeer  p2p.ID
+	FirstHash  tmbytes.HexBytes
+	SecondPeer p2p.ID
+	SecondHash tmbytes.HexBytes
+}
+
+func (e ErrConflictingBlocks) Error() string {
+	return fmt.Sprintf("conflicting blocks at height %d: peer %v sent %v, peer %v sent %v",
+		e.Height, e.FirstPeer, e.FirstHash, e.SecondPeer, e.SecondHash)
+}
+
+// ErrConsumerBehind means the pool holds too many blocks that haven't been
+// popped yet, i.e. blocks are executed slower than they're downloaded.
+type ErrConsumerBehind struct {
+	NumStored int
+	MaxStored int
+}
+
+func (e ErrConsumerBehind) Error() string {
+	return fmt.Sprintf("consumer is behind: %d blocks stored, max %d", e.NumStored, e.MaxStored)
+}
+
+// ErrPinnedPeerRemoved means the peer a height is pinned to (see
+// BlockPool.PinRequest) was removed, so the height can't be requested until
+// the peer is added back.
+type ErrPinnedPeerRemoved struct {
+	Height int64
+	PeerID p2p.ID
+}
+
+func (e ErrPinnedPeerRemoved) Error() string {
+	return fmt.Sprintf("peer %v, which height %d is pinned to, was removed", e.PeerID, e.Height)
+}
+
+// ErrPeerHeightDecreased means a peer reported a lower height than it did
+// before.
+type ErrPeerHeightDecreased struct {
+	PeerID     p2p.ID
+	PrevHeight int64
+	Height     int64
+}
+
+func (e ErrPeerHeightDecreased) Error() string {
+	return fmt.Sprintf("peer %v reported height %d, lower than its previous height %d",
+		e.PeerID, e.Height, e.PrevHeight)
+}
+
+// ErrCoalesced wraps an error reported for a peer after other errors for the
+// same peer were dropped because of the rate limit (see WithErrorRateLimit).
+type ErrCoalesced struct {
+	Err           error
+	NumSuppressed int
+}
+
+func (e ErrCoalesced) Error() string {
+	return fmt.Sprintf("%v (%d more errors suppressed)", e.Err, e.NumSuppressed)
+}
+
+func (e ErrCoalesced) Unwrap() error {
+	return e.Err
+}
+
+// MultiError combines the errors caused by a single event, e.g. the removal of
+// a peer many heights are pinned to, so that they're logged and reported once.
+type MultiError struct {
+	Errors []error
+}
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
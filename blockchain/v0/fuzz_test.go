@@ -0,0 +1,134 @@
+package v0
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tendermint/tendermint/p2p"
+	"github.com/tendermint/tendermint/types"
+)
+
+// fuzzHarness drives a running pool, either with a goroutine per requester or
+// with requester workers. The pool's own goroutines make requesters and assign
+// them peers concurrently with the harness' operations.
+type fuzzHarness struct {
+	pool       *BlockPool
+	requestsCh chan BlockRequest
+	errorsCh   chan peerError
+}
+
+func newFuzzHarness(withWorkers bool) *fuzzHarness {
+	h := &fuzzHarness{
+		requestsCh: make(chan BlockRequest, maxTotalRequesters),
+		errorsCh:   make(chan peerError, 1000),
+	}
+	// wait for the pool's goroutines on stop, so none outlive the run.
+	options := []BlockPoolOption{WithShutdownTimeout(time.Second)}
+	if withWorkers {
+		options = append(options, WithRequesterWorkers(1))
+	}
+	pool, err := NewBlockPool(1, h.requestsCh, h.errorsCh, options...)
+	if err != nil {
+		panic(err)
+	}
+	if err := pool.Start(); err != nil {
+		panic(err)
+	}
+	h.pool = pool
+	return h
+}
+
+// Stops the pool along with the peers' timers, which the pool's own OnStop
+// would otherwise leave running.
+func (h *fuzzHarness) stop() {
+	h.pool.mtx.Lock()
+	for peerID := range h.pool.peers {
+		h.pool.removePeer(peerID, "stopped")
+	}
+	h.pool.mtx.Unlock()
+
+	if err := h.pool.Stop(); err != nil {
+		panic(err)
+	}
+}
+
+// Drops whatever the pool sent, so that it never blocks.
+func (h *fuzzHarness) drain() {
+	for len(h.requestsCh) > 0 {
+		<-h.requestsCh
+	}
+	for len(h.errorsCh) > 0 {
+		<-h.errorsCh
+	}
+}
+
+func (h *fuzzHarness) checkInvariants(prevHeight int64) {
+	h.pool.mtx.Lock()
+	defer h.pool.mtx.Unlock()
+
+	if numPending := h.pool.numPending; numPending < 0 {
+		panic(fmt.Sprintf("numPending is negative: %d", numPending))
+	}
+	if h.pool.height < prevHeight {
+		panic(fmt.Sprintf("height went from %d down to %d", prevHeight, h.pool.height))
+	}
+	for height := range h.pool.requesters {
+		if height < h.pool.height {
+			panic(fmt.Sprintf("requester at %d below the pool's height %d", height, h.pool.height))
+		}
+	}
+	for _, peer := range h.pool.peers {
+		if peer.numPending < 0 {
+			panic(fmt.Sprintf("peer %v has %d pending requests", peer.id, peer.numPending))
+		}
+	}
+}
+
+// Runs the operations encoded in data, 3 bytes each: the operation and the
+// peer, a height and a size.
+func (h *fuzzHarness) run(data []byte) {
+	for ; len(data) >= 3; data = data[3:] {
+		op, peerID := data[0]%5, p2p.ID(fmt.Sprintf("peer%d", data[0]/5%4))
+		height := int64(int8(data[1]))
+		size := int(data[2]) * 100
+
+		prevHeight, _, _ := h.pool.GetStatus()
+		switch op {
+		case 0:
+			h.pool.SetPeerRange(peerID, height/4, height)
+		case 1:
+			h.pool.RemovePeer(peerID)
+		case 2:
+			h.pool.AddBlock(peerID, &types.Block{Header: types.Header{Height: height}}, size)
+		case 3:
+			h.pool.makeNextRequester()
+		case 4:
+			if first, second, _ := h.pool.PeekTwoBlocks(); first != nil && second != nil {
+				if err := h.pool.PopRequest(); err != nil {
+					panic(err)
+				}
+			}
+		}
+		h.drain()
+		h.checkInvariants(prevHeight)
+	}
+}
+
+func FuzzBlockPoolAddBlock(f *testing.F) {
+	for _, withWorkers := range []bool{false, true} {
+		f.Add(withWorkers, []byte{})
+		// a peer, two requesters, both blocks and a pop.
+		f.Add(withWorkers, []byte{0, 10, 0, 3, 0, 0, 3, 0, 0, 2, 1, 1, 2, 2, 1, 4, 0, 0})
+		// a block from a removed peer.
+		f.Add(withWorkers, []byte{0, 10, 0, 3, 0, 0, 1, 0, 0, 2, 1, 1, 4, 0, 0})
+		// unexpected, negative and duplicate heights.
+		f.Add(withWorkers, []byte{0, 10, 0, 3, 0, 0, 2, 127, 1, 2, 200, 1, 2, 1, 1, 2, 1, 1})
+	}
+
+	f.Fuzz(func(t *testing.T, withWorkers bool, data []byte) {
+		h := newFuzzHarness(withWorkers)
+		defer h.stop()
+		h.run(data)
+	})
+}
@@ -0,0 +1,151 @@
+package v0
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tendermint/tendermint/libs/log"
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+)
+
+// dedupLogger logs the first occurrence of an error at its level and repeats
+// of it, until the next flush, at debug level only. Errors are identified by
+// the message, the type of the "err" value and the "peer" value, so that a
+// peer failing the same way over and over doesn't flood the logs. Messages
+// without an "err" value are passed through. See WithLogDedup.
+type dedupLogger struct {
+	logger  log.Logger
+	context []interface{} // keyvals passed to With
+	state   *dedupState   // shared with the loggers made by With
+}
+
+type dedupKey struct {
+	msg     string
+	errType string
+	peer    string
+}
+
+type dedupEntry struct {
+	error    bool // logged at error level, else at info
+	keyvals  []interface{}
+	logger   log.Logger
+	numDupes int
+}
+
+type dedupState struct {
+	mtx     tmsync.Mutex
+	entries map[dedupKey]*dedupEntry
+}
+
+var _ log.Logger = (*dedupLogger)(nil)
+
+func newDedupLogger(logger log.Logger) *dedupLogger {
+	return &dedupLogger{
+		logger: logger,
+		state:  &dedupState{entries: make(map[dedupKey]*dedupEntry)},
+	}
+}
+
+func (l *dedupLogger) Debug(msg string, keyvals ...interface{}) {
+	l.logger.Debug(msg, keyvals...)
+}
+
+func (l *dedupLogger) Info(msg string, keyvals ...interface{}) {
+	if l.isDupe(false, msg, keyvals) {
+		return
+	}
+	l.logger.Info(msg, keyvals...)
+}
+
+func (l *dedupLogger) Error(msg string, keyvals ...interface{}) {
+	if l.isDupe(true, msg, keyvals) {
+		return
+	}
+	l.logger.Error(msg, keyvals...)
+}
+
+func (l *dedupLogger) With(keyvals ...interface{}) log.Logger {
+	return &dedupLogger{
+		logger:  l.logger.With(keyvals...),
+		context: append(append([]interface{}{}, l.context...), keyvals...),
+		state:   l.state,
+	}
+}
+
+// Returns true, after logging it at debug level, if the message repeats an
+// error logged since the last flush.
+func (l *dedupLogger) isDupe(isError bool, msg string, keyvals []interface{}) bool {
+	err, ok := lookupKeyval("err", keyvals)
+	if !ok {
+		return false
+	}
+	peer, ok := lookupKeyval("peer", keyvals)
+	if !ok {
+		peer, _ = lookupKeyval("peer", l.context)
+	}
+	key := dedupKey{msg: msg, errType: fmt.Sprintf("%T", err), peer: fmt.Sprint(peer)}
+
+	l.state.mtx.Lock()
+	defer l.state.mtx.Unlock()
+
+	entry, ok := l.state.entries[key]
+	if !ok {
+		l.state.entries[key] = &dedupEntry{error: isError, keyvals: keyvals, logger: l.logger}
+		return false
+	}
+	entry.numDupes++
+	l.logger.Debug(msg, append(append([]interface{}{}, keyvals...), "repeated", entry.numDupes)...)
+	return true
+}
+
+// Logs how many times each error was repeated since the last flush, at the
+// error's level, and forgets about the errors so that their next occurrence is
+// logged in full.
+func (l *dedupLogger) flush() {
+	l.state.mtx.Lock()
+	defer l.state.mtx.Unlock()
+
+	for key, entry := range l.state.entries {
+		if entry.numDupes > 0 {
+			keyvals := append(append([]interface{}{}, entry.keyvals...), "repeated", entry.numDupes)
+			msg := key.msg + " (repeated)"
+			if entry.error {
+				entry.logger.Error(msg, keyvals...)
+			} else {
+				entry.logger.Info(msg, keyvals...)
+			}
+		}
+	}
+	l.state.entries = make(map[dedupKey]*dedupEntry)
+}
+
+func lookupKeyval(key string, keyvals []interface{}) (interface{}, bool) {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == key {
+			return keyvals[i+1], true
+		}
+	}
+	return nil, false
+}
+
+// Flushes the pool's dedupLogger every interval, see WithLogDedup.
+func (pool *BlockPool) logDedupRoutine() {
+	ticker := time.NewTicker(pool.logDedupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pool.stopCh:
+			pool.flushLogDedup()
+			return
+		case <-ticker.C:
+			pool.flushLogDedup()
+		}
+	}
+}
+
+func (pool *BlockPool) flushLogDedup() {
+	if l, ok := pool.Logger.(*dedupLogger); ok {
+		l.flush()
+	}
+}
@@ -0,0 +1,63 @@
+package v0
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/libs/log"
+)
+
+func TestBlockPoolLogDedup(t *testing.T) {
+	var buf bytes.Buffer
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError), WithLogDedup(time.Hour))
+	require.NoError(t, err)
+	pool.SetLogger(log.NewFilter(log.NewTMLogger(log.NewSyncWriter(&buf)), log.AllowInfo()))
+
+	// 500 identical errors: the peer's height keeps going down.
+	pool.SetPeerRange("peer", 1, 1000)
+	for i := 0; i < 500; i++ {
+		pool.SetPeerRange("peer", 1, int64(999-i))
+	}
+	// another peer's errors are logged separately.
+	pool.SetPeerRange("other", 1, 1000)
+	pool.SetPeerRange("other", 1, 999)
+
+	countLines := func(substr string) int {
+		return strings.Count(buf.String(), substr)
+	}
+	assert.Equal(t, 2, countLines("Peer reported a lower height than before"))
+
+	pool.flushLogDedup()
+	assert.Equal(t, 1, countLines("repeated=499"))
+
+	// the next occurrence is logged in full again.
+	buf.Reset()
+	pool.SetPeerRange("peer", 1, 1)
+	assert.Equal(t, 1, countLines("Peer reported a lower height than before"))
+	assert.Equal(t, 0, countLines("repeated"))
+}
+
+func TestBlockPoolLogDedupFlushedOnStop(t *testing.T) {
+	var buf bytes.Buffer
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError),
+		WithLogDedup(time.Hour), WithShutdownTimeout(time.Second))
+	require.NoError(t, err)
+	pool.SetLogger(log.NewFilter(log.NewTMLogger(log.NewSyncWriter(&buf)), log.AllowInfo()))
+	require.NoError(t, pool.Start())
+
+	pool.SetPeerRange("peer", 1, 1000)
+	for i := 0; i < 3; i++ {
+		pool.SetPeerRange("peer", 1, int64(999-i))
+	}
+
+	start := time.Now()
+	require.NoError(t, pool.Stop())
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Empty(t, pool.aliveRoutines())
+	assert.Contains(t, buf.String(), "repeated=2")
+}
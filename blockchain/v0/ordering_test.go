@@ -0,0 +1,122 @@
+package v0
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/libs/log"
+	tmrand "github.com/tendermint/tendermint/libs/rand"
+	"github.com/tendermint/tendermint/p2p"
+	"github.com/tendermint/tendermint/types"
+)
+
+// orderingHarness feeds blocks to a pool out of order from several mock peers
+// and checks that PeekTwoBlocks and PopRequest yield strictly increasing
+// heights, without gaps.
+type orderingHarness struct {
+	t          *testing.T
+	pool       *BlockPool
+	requestsCh chan BlockRequest
+	rand       *tmrand.Rand
+
+	// heights of the popped blocks, see WithOnBlockPopped
+	popped []int64
+}
+
+func newOrderingHarness(t *testing.T, start int64, seed int64, options ...BlockPoolOption) *orderingHarness {
+	h := &orderingHarness{
+		t:          t,
+		requestsCh: make(chan BlockRequest, maxTotalRequesters),
+		rand:       tmrand.NewRand(),
+	}
+	h.rand.Seed(seed)
+	options = append(options, WithOnBlockPopped(func(block *types.Block) {
+		h.popped = append(h.popped, block.Height)
+	}))
+	pool, err := NewBlockPool(start, h.requestsCh, make(chan peerError, 1000), options...)
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	require.NoError(t, pool.Start())
+	t.Cleanup(func() {
+		if err := pool.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	h.pool = pool
+	return h
+}
+
+// run syncs the pool up to target from numPeers peers. The pending requests
+// are answered in a random order, and pops are interleaved with deliveries.
+func (h *orderingHarness) run(numPeers int, target int64) {
+	for i := 0; i < numPeers; i++ {
+		h.pool.SetPeerRange(p2p.ID(fmt.Sprintf("peer%d", i)), 1, target+1)
+	}
+
+	start, _, _ := h.pool.GetStatus()
+	timeout := time.After(10 * time.Second)
+	var pending []BlockRequest
+	for {
+		height, _, _ := h.pool.GetStatus()
+		if height == target {
+			break
+		}
+
+		select {
+		case request := <-h.requestsCh:
+			pending = append(pending, request)
+			continue
+		case <-timeout:
+			h.t.Fatalf("timed out at height %d", height)
+		default:
+		}
+
+		if len(pending) > 0 {
+			i := h.rand.Intn(len(pending))
+			request := pending[i]
+			pending = append(pending[:i], pending[i+1:]...)
+			block := &types.Block{Header: types.Header{Height: request.Height}}
+			h.pool.AddBlock(request.PeerID, block, 123)
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+
+		if h.rand.Intn(2) == 0 {
+			h.popIfReady()
+		}
+	}
+
+	require.Len(h.t, h.popped, int(target-start))
+	for i, height := range h.popped {
+		require.Equal(h.t, start+int64(i), height, "popped heights %v", h.popped)
+	}
+}
+
+// Pops the first block if the first two are available, checking they're the
+// ones at the pool's height.
+func (h *orderingHarness) popIfReady() {
+	first, second, _ := h.pool.PeekTwoBlocks()
+	if first == nil || second == nil {
+		return
+	}
+	height, _, _ := h.pool.GetStatus()
+	require.Equal(h.t, height, first.Height)
+	require.Equal(h.t, height+1, second.Height)
+	require.NoError(h.t, h.pool.PopRequest())
+}
+
+func TestBlockPoolOrdering(t *testing.T) {
+	for seed := int64(0); seed < 3; seed++ {
+		seed := seed
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			newOrderingHarness(t, 1, seed).run(4, 200)
+		})
+	}
+}
+
+func TestBlockPoolOrderingRequesterWorkers(t *testing.T) {
+	newOrderingHarness(t, 1, 0, WithRequesterWorkers(4)).run(4, 200)
+}
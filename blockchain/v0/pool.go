@@ -1,17 +1,25 @@
 package v0
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"math"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	tmbytes "github.com/tendermint/tendermint/libs/bytes"
 	flow "github.com/tendermint/tendermint/libs/flowrate"
 	"github.com/tendermint/tendermint/libs/log"
+	tmrand "github.com/tendermint/tendermint/libs/rand"
 	"github.com/tendermint/tendermint/libs/service"
 	tmsync "github.com/tendermint/tendermint/libs/sync"
 	"github.com/tendermint/tendermint/p2p"
+	bcproto "github.com/tendermint/tendermint/proto/tendermint/blockchain"
 	"github.com/tendermint/tendermint/types"
 )
 
@@ -34,20 +42,63 @@ const (
 	maxPendingRequestsPerPeer = 20
 	requestRetrySeconds       = 30
 
-	// Minimum recv rate to ensure we're receiving blocks from a peer fast
-	// enough. If a peer is not sending us data at at least that rate, we
-	// consider them to have timedout and we disconnect.
+	// Retry timeout for the blocks at pool.height and pool.height+1, which
+	// nothing can be popped without.
+	priorityRequestRetrySeconds = 5
+
+	// Minimum recv rate, in bytes per second, to ensure we're receiving blocks
+	// from a peer fast enough. If a peer is not sending us data at at least that
+	// rate, we consider them to have timedout and we disconnect. Like the rate
+	// reported by the peer's flow monitor, it's measured from the sizes of the
+	// received blocks in bytes.
 	//
 	// Assuming a DSL connection (not a good choice) 128 Kbps (upload) ~ 15 KB/s,
 	// sending data across atlantic ~ 7.5 KB/s.
 	minRecvRate = 7680
 
-	// Maximum difference between current and new block's height.
-	maxDiffBetweenCurrentAndReceivedBlockHeight = 100
+	// Default time after a peer is added during which it isn't disconnected
+	// for sending data slower than minRecvRate.
+	defaultRateCheckGracePeriod = 5 * time.Second
+
+	// Default number of heights included in DebugString.
+	defaultDebugStringMaxHeights = 100
+
+	// Number of popped blocks over which the sync rate is measured.
+	syncRateWindow = 100
+
+	// Number of delivered block sizes sampled by BlockSizeStats.
+	blockSizeSamples = 100
+
+	// Default number of per-window sync rates kept by the pool.
+	defaultSyncRateHistorySize = 10
+
+	// Default number of popped heights kept in the delivery audit.
+	defaultDeliveryAuditSize = 1000
+
+	// Default maximum difference between current and new block's height.
+	defaultMaxDiffBetweenCurrentAndReceivedBlockHeight = 100
+
+	// Maximum number of peers a requester remembers as having failed its
+	// height.
+	maxFailedPeersPerHeight = 10
+
+	// Default number of errors per peer sent to errorsCh within
+	// defaultErrorWindow. Further errors are coalesced.
+	defaultErrorBurst  = 10
+	defaultErrorWindow = time.Second
+
+	// Number of blocks a peer may deliver for heights which already have one
+	// before it's removed. Benign duplicates (e.g. a block arriving right
+	// after a retry) are rare.
+	maxDuplicateBlocks = 3
 )
 
 var peerTimeout = 15 * time.Second // not const so we can override with tests
 
+// Maximum random delay added to peerTimeout, as a fraction of it, so that peers
+// hit by the same network blip don't all time out at once.
+const peerTimeoutJitter = 0.1
+
 /*
 	Peers self report their heights when we join the block pool.
 	Starting from our latest pool.height, we request blocks
@@ -61,8 +112,19 @@ var peerTimeout = 15 * time.Second // not const so we can override with tests
 
 // BlockPool keeps track of the fast sync peers, block requests and block responses.
 type BlockPool struct {
+	// atomic, kept first for 64-bit alignment
+	wastedBytes int64 // size of the received blocks discarded by redos
+	totalBytes  int64 // size of all the blocks received
+	// time requesters spent without a peer, see PeerStarvationTime
+	starvationTime int64
+	// when numBlockedSends last went from none to some and the longest send
+	// since the channel watchdog's last check, see SetChannelWatchdog
+	sendsBlockedSince int64
+	maxSendLatency    int64
+
 	service.BaseService
-	startTime time.Time
+	startTime   time.Time
+	startHeight int64
 
 	mtx tmsync.Mutex
 	// block requests
@@ -71,39 +133,808 @@ type BlockPool struct {
 	// peers
 	peers         map[p2p.ID]*bpPeer
 	maxPeerHeight int64 // the biggest reported height
+	// the biggest height reported by a peer which has delivered a block, see
+	// WithTrustedMaxPeerHeight
+	trustedPeerHeight int64
+	// heights which may only be served by a given peer, see PinRequest
+	pinned map[int64]p2p.ID
+	// heights advanced past without a block, see SkipHeight
+	skippedHeights []int64
 
 	// atomic
-	numPending int32 // number of requests pending assignment or block response
+	numPending     int32  // number of requests pending assignment or block response
+	channelsClosed uint32 // set by NotifyChannelsClosed
+	paused         uint32 // see Pause
+	// see NumRequesterGoroutines
+	numRequesterRoutines int32
+
+	// see TraceHeight
+	tracesMtx    tmsync.Mutex
+	traces       map[int64][]chan HeightEvent
+	numTraces    int32
+	tracesClosed bool // set once the pool is stopped
+
+	// see SetChannelWatchdog
+	watchdogInterval time.Duration
+	numBlockedSends  int32 // sends on requestsCh and errorsCh in progress
+
+	// sync rate, updated every syncRateWindow popped blocks
+	numPopped      int64
+	lastWindowTime time.Time
+	lastSyncRate   float64
+	// the total size and number of the popped blocks, see ThroughputMBps
+	poppedBytes     int64
+	numPoppedBlocks int64
+	// sizes of the last delivered blocks, see BlockSizeStats
+	blockSizes    [blockSizeSamples]int
+	nextBlockSize int // index the next size is written at
+	numBlockSizes int
+	// raw rates of the last windows, oldest first, see WithSyncRateHistorySize
+	syncRateHistory     []float64
+	syncRateHistorySize int
+	// the last popped heights, oldest first, see WithDeliveryAuditSize
+	deliveryAudit     []DeliveryRecord
+	deliveryAuditSize int
 
 	requestsCh chan<- BlockRequest
 	errorsCh   chan<- peerError
+	// held for reading while sending on requestsCh or errorsCh, and for writing
+	// by NotifyChannelsClosed
+	channelsMtx tmsync.RWMutex
+	// closed by NotifyChannelsClosed to abort the sends in progress
+	channelsClosing chan struct{}
+
+	// how long OnStop waits for the pool's goroutines to exit
+	shutdownTimeout time.Duration
+	// see WithContext
+	ctx context.Context
+	// see WithMaxStalledBlocks
+	maxStalledBlocks int
+	// see WithRateLimitingDisabled
+	disableRateLimiting bool
+	// see WithMaxPeers
+	maxPeers      int
+	onPeerEvicted func(p2p.ID)
+	// see WithEvictionPolicy
+	evictionPolicy EvictionPolicy
+	// see WithPeerEventLogLevel
+	peerEventLogLevel string
+	// see WithMaxStoredBlocks
+	maxStoredBlocks int
+	consumerBehind  bool
+	// see WithPrefetchAhead
+	prefetchAhead int64
+	// see WithEndHeight
+	endHeight int64
+	// see WithHeightDecreasePolicy
+	heightDecreasePolicy HeightDecreasePolicy
+	// see WithErrorRateLimit
+	errorBurst     int
+	errorWindow    time.Duration
+	errorLimitsMtx tmsync.Mutex
+	errorLimits    map[p2p.ID]*errorLimit
+	// see WithHeadPriority
+	headPriority bool
+	// see WithTrustedMaxPeerHeight
+	trustedMaxPeerHeight bool
+	// see WithDebugStringMaxHeights
+	debugStringMaxHeights int
+	// see WithRateCheckGracePeriod
+	rateCheckGracePeriod time.Duration
+	// see WithRecvRateSeed
+	recvRateSeed float64
+	// see WithSlowPeerProbation
+	slowPeerProbation time.Duration
+	// see WithAutoRemoveSlowPeers
+	autoRemoveSlowPeers bool
+	// see WithStandbyPeers
+	standbyPeers bool
+	// see WithMaxUnexpectedBlockDiff
+	maxUnexpectedBlockDiff int64
+	// see WithMaxPeerHeightLead
+	maxPeerHeightLead int64
+	// see WithMaxPeerRangeSpan
+	maxPeerRangeSpan int64
+	// see WithLogDedup
+	logDedupInterval time.Duration
+	// see WithSamePeerRetries
+	samePeerRetries    int
+	samePeerRetryDelay time.Duration
+	// see WithPeerSelector
+	peerSelector PeerSelector
+	// see WithCommitVerifier
+	commitVerifier CommitVerifier
+	// see WithOnBlockPopped
+	onBlockPopped func(*types.Block)
+	// see WithOnRequesterReassigned
+	onRequesterReassigned func(height int64, from, to p2p.ID)
+	// see WithMaxDeliveryReorder
+	maxDeliveryReorder int64
+	// see WithOnPeerAdd
+	onPeerAdd func(peerID p2p.ID, base, height int64) PeerAdmission
+	// see WithOnNoPeers
+	onNoPeers func()
+	// see WithBlockProvider
+	blockProvider BlockProvider
+	// see WithRequesterWorkers
+	requesterWorkers int
+	requesterQueue   *requesterQueue
+	// see WithJitterSource
+	jitterSource func() float64
+	// see WithMaxBlockBytes
+	maxBlockBytes int
+	// creates the monitors measuring the peers' receive rates
+	newRecvMonitor func() rateMonitor
+	// see WithCaughtUpChecks
+	minCaughtUpChecks int
+	numCaughtUpChecks int
+	wasCaughtUp       bool
+	numCaughtUpFlaps  int
+
+	// number of goroutines spawned by the pool, keyed by name; a requester's
+	// goroutine may outlive it while a new one runs for the same height
+	routinesWg  sync.WaitGroup
+	routinesMtx tmsync.Mutex
+	routines    map[string]int
+	// closed at the start of OnStop, so the spawned goroutines can exit before
+	// it waits for them; Quit is only closed once OnStop returns
+	stopCh chan struct{}
 }
 
+// BlockPoolOption sets an optional parameter on the BlockPool.
+type BlockPoolOption func(*BlockPool)
+
 // NewBlockPool returns a new BlockPool with the height equal to start. Block
 // requests and errors will be sent to requestsCh and errorsCh accordingly.
-func NewBlockPool(start int64, requestsCh chan<- BlockRequest, errorsCh chan<- peerError) *BlockPool {
+// It returns an error if start is not positive.
+//
+// The channels are owned by the caller. The pool never closes them; if the
+// caller does, it must call NotifyChannelsClosed first.
+func NewBlockPool(
+	start int64,
+	requestsCh chan<- BlockRequest,
+	errorsCh chan<- peerError,
+	options ...BlockPoolOption,
+) (*BlockPool, error) {
+	if start < 1 {
+		return nil, fmt.Errorf("invalid start height %d: must be positive", start)
+	}
+
 	bp := &BlockPool{
 		peers: make(map[p2p.ID]*bpPeer),
 
-		requesters: make(map[int64]*bpRequester),
-		height:     start,
-		numPending: 0,
-
-		requestsCh: requestsCh,
-		errorsCh:   errorsCh,
+		requesters:  make(map[int64]*bpRequester),
+		pinned:      make(map[int64]p2p.ID),
+		height:      start,
+		startHeight: start,
+		numPending:  0,
+
+		requestsCh:      requestsCh,
+		errorsCh:        errorsCh,
+		channelsClosing: make(chan struct{}),
+
+		routines: make(map[string]int),
+		stopCh:   make(chan struct{}),
+
+		peerEventLogLevel: "info",
+		prefetchAhead:     maxTotalRequesters,
+		errorBurst:        defaultErrorBurst,
+		errorWindow:       defaultErrorWindow,
+		errorLimits:       make(map[p2p.ID]*errorLimit),
+		jitterSource:      tmrand.Float64,
+		newRecvMonitor:    newFlowMonitor,
+		requesterQueue:    newRequesterQueue(),
+
+		syncRateHistorySize: defaultSyncRateHistorySize,
+		deliveryAuditSize:   defaultDeliveryAuditSize,
+
+		debugStringMaxHeights: defaultDebugStringMaxHeights,
+		rateCheckGracePeriod:  defaultRateCheckGracePeriod,
+		recvRateSeed:          math.E,
+		autoRemoveSlowPeers:   true,
+		peerSelector:          DefaultSelector{},
+		minCaughtUpChecks:     1,
+
+		maxUnexpectedBlockDiff: defaultMaxDiffBetweenCurrentAndReceivedBlockHeight,
 	}
 	bp.BaseService = *service.NewBaseService(nil, "BlockPool", bp)
-	return bp
+	for _, option := range options {
+		option(bp)
+	}
+	return bp, nil
+}
+
+// WithShutdownTimeout sets how long OnStop waits for the requester goroutines
+// to exit. If the timeout elapses, the goroutines still alive are logged. Zero
+// (the default) means OnStop does not wait at all.
+func WithShutdownTimeout(timeout time.Duration) BlockPoolOption {
+	return func(pool *BlockPool) { pool.shutdownTimeout = timeout }
+}
+
+// WithContext makes the pool stop when ctx is done, as if Stop was called, so
+// that cancelling a parent context shuts down all the pool's goroutines.
+func WithContext(ctx context.Context) BlockPoolOption {
+	return func(pool *BlockPool) { pool.ctx = ctx }
+}
+
+// WithMaxStalledBlocks sets how many blocks a peer may deliver while
+// withholding the block at the pool's height it was asked for. Such a peer
+// keeps its receive rate above minRecvRate and its timeout from firing, yet
+// never lets the pool advance. Up to maxPendingRequestsPerPeer-1 (19) requests
+// sent before the one for the pool's height may legitimately arrive first, so
+// twice maxPendingRequestsPerPeer (40) is a reasonable value. Zero disables
+// the check, which is the default.
+func WithMaxStalledBlocks(n int) BlockPoolOption {
+	return func(pool *BlockPool) { pool.maxStalledBlocks = n }
+}
+
+// WithRateLimitingDisabled turns off receive rate tracking, so peers are no
+// longer disconnected for sending data slower than minRecvRate. Peers which
+// send nothing at all are still dropped after peerTimeout.
+//
+// This avoids disconnecting peers during brief pauses (e.g. GC) on a network
+// of trusted peers. Do NOT use it with untrusted peers: a malicious peer may
+// then keep us syncing at an arbitrarily slow rate.
+func WithRateLimitingDisabled() BlockPoolOption {
+	return func(pool *BlockPool) { pool.disableRateLimiting = true }
+}
+
+// WithMaxPeers caps the number of peers tracked by the pool. Once the cap is
+// reached, SetPeerRange evicts a peer, chosen according to the pool's
+// EvictionPolicy, to make room for the new one, and refuses the new peer if
+// there's no peer to evict. onEvict, if not nil, is called with the ID of every
+// evicted peer. Zero (the default) means no limit.
+func WithMaxPeers(max int, onEvict func(p2p.ID)) BlockPoolOption {
+	return func(pool *BlockPool) {
+		pool.maxPeers = max
+		pool.onPeerEvicted = onEvict
+	}
+}
+
+// EvictionPolicy tells the pool which peer to evict when it's full, see
+// WithMaxPeers.
+type EvictionPolicy int
+
+const (
+	// EvictLowestHeight evicts the peer with the lowest height if the new peer
+	// is taller (the default).
+	EvictLowestHeight EvictionPolicy = iota
+	// EvictWorstReputation evicts the peer with the worst reputation (see
+	// PeerReputation): the one with the most rejected blocks and timeouts
+	// net of the blocks it delivered. A peer with a negative balance is
+	// always evicted; among peers with an even balance, e.g. those which
+	// were never asked for a block, the lowest one is evicted if the new peer
+	// is taller. Peers with a positive balance are never evicted.
+	EvictWorstReputation
+)
+
+// WithEvictionPolicy sets which peer SetPeerRange evicts when the pool is
+// full, see WithMaxPeers. Defaults to EvictLowestHeight.
+func WithEvictionPolicy(policy EvictionPolicy) BlockPoolOption {
+	return func(pool *BlockPool) { pool.evictionPolicy = policy }
+}
+
+// WithPeerEventLogLevel sets the level ("debug", "info", "error" or "none") at
+// which peer lifecycle events are logged. Defaults to "info".
+func WithPeerEventLogLevel(level string) BlockPoolOption {
+	return func(pool *BlockPool) { pool.peerEventLogLevel = level }
+}
+
+// WithMaxStoredBlocks sets how many received, but not yet popped blocks the
+// pool may hold. Once it's reached, no new requesters are spawned until the
+// consumer catches up, and ErrConsumerBehind is logged to tell operators that
+// block execution, not the network, is the bottleneck. Zero (the default)
+// means the number of requesters is the only limit.
+func WithMaxStoredBlocks(n int) BlockPoolOption {
+	return func(pool *BlockPool) { pool.maxStoredBlocks = n }
+}
+
+// WithPrefetchAhead limits how many heights beyond the pool's height blocks
+// are requested for. A small window saves bandwidth when the node is about to
+// switch to consensus; a large one keeps more requests in flight. Defaults to
+// maxTotalRequesters.
+func WithPrefetchAhead(n int64) BlockPoolOption {
+	return func(pool *BlockPool) { pool.prefetchAhead = n }
+}
+
+// WithErrorRateLimit sets how many errors per peer are sent to errorsCh within
+// window. Further errors from the peer are dropped until the window ends; the
+// first error sent afterwards is wrapped in ErrCoalesced, which carries the
+// number of errors dropped. This keeps a misbehaving peer from flooding the
+// consumer of errorsCh. Zero burst means no limit. Defaults to 10 errors per
+// second.
+func WithErrorRateLimit(window time.Duration, burst int) BlockPoolOption {
+	return func(pool *BlockPool) {
+		pool.errorWindow = window
+		pool.errorBurst = burst
+	}
+}
+
+// WithEndHeight makes the pool request only the blocks below end, so that it
+// syncs the heights [start, end). Zero (the default) means no limit.
+func WithEndHeight(end int64) BlockPoolOption {
+	return func(pool *BlockPool) { pool.endHeight = end }
+}
+
+// HeightDecreasePolicy tells the pool what to do when a peer reports a height
+// lower than it previously did. That usually means the peer rolled back or is
+// lying about its chain.
+type HeightDecreasePolicy int
+
+const (
+	// HeightDecreaseAccept records the lower height (the default).
+	HeightDecreaseAccept HeightDecreasePolicy = iota
+	// HeightDecreaseReject keeps the previous base and height.
+	HeightDecreaseReject
+	// HeightDecreaseDisconnect removes the peer and reports
+	// ErrPeerHeightDecreased.
+	HeightDecreaseDisconnect
+)
+
+// WithHeightDecreasePolicy sets what SetPeerRange does when a peer reports a
+// lower height than before. Whatever the policy, the decrease is logged.
+func WithHeightDecreasePolicy(policy HeightDecreasePolicy) BlockPoolOption {
+	return func(pool *BlockPool) { pool.heightDecreasePolicy = policy }
+}
+
+// WithHeadPriority enables or disables prioritization of the blocks at the
+// pool's height and the one after, which are on the critical path: nothing
+// can be popped until they arrive. When enabled, they're requested from the
+// least loaded, fastest peer and retried after 5s instead of 30s. On slow links
+// a big block may then never arrive in time, so it's disabled by default.
+func WithHeadPriority(enabled bool) BlockPoolOption {
+	return func(pool *BlockPool) { pool.headPriority = enabled }
+}
+
+// WithTrustedMaxPeerHeight makes the height the pool syncs up to, as seen by
+// IsCaughtUp, Progress and MaxPeerHeight, only account for peers which have
+// delivered at least one valid block. Otherwise a single peer reporting a
+// made up height makes the node chase a tip which doesn't exist. Blocks are
+// still requested up to the highest reported height, see ReportedMaxHeight.
+// Disabled by default.
+func WithTrustedMaxPeerHeight(enabled bool) BlockPoolOption {
+	return func(pool *BlockPool) { pool.trustedMaxPeerHeight = enabled }
+}
+
+// WithDebugStringMaxHeights sets the maximum number of heights DebugString
+// includes. Defaults to 100.
+func WithDebugStringMaxHeights(n int) BlockPoolOption {
+	return func(pool *BlockPool) { pool.debugStringMaxHeights = n }
+}
+
+// WithRateCheckGracePeriod sets how long after a peer is added it's exempt
+// from the minRecvRate check, so that freshly added peers, which haven't had
+// a chance to deliver anything yet, aren't culled right away. Peers which send
+// nothing at all are still dropped after peerTimeout. Defaults to 5s.
+func WithRateCheckGracePeriod(d time.Duration) BlockPoolOption {
+	return func(pool *BlockPool) { pool.rateCheckGracePeriod = d }
+}
+
+// WithRecvRateSeed sets the multiple of minRecvRate a peer's receive rate
+// starts from. The rate is an exponential moving average, so without a seed a
+// new peer would start at zero and look slow until enough samples arrive. Too
+// low a seed makes peers on fast links look slow early on; too high a seed
+// hides slow peers for longer. Defaults to math.E.
+func WithRecvRateSeed(multiplier float64) BlockPoolOption {
+	return func(pool *BlockPool) { pool.recvRateSeed = multiplier }
+}
+
+// WithSlowPeerProbation puts a peer whose receive rate drops below minRecvRate
+// on probation for d instead of disconnecting it right away: its rate is reset
+// and checked again once d has passed, so that a transient slow patch doesn't
+// cost us the peer. A peer which is still slow then is disconnected; one which
+// has recovered is taken off probation. Defaults to 0, i.e. disabled.
+func WithSlowPeerProbation(d time.Duration) BlockPoolOption {
+	return func(pool *BlockPool) { pool.slowPeerProbation = d }
+}
+
+// WithAutoRemoveSlowPeers sets whether peers which timed out or are too slow
+// are removed from the pool. If disabled, they're still reported on errorsCh
+// and no longer picked for requests, but removing them is left to the
+// reactor. Defaults to true.
+func WithAutoRemoveSlowPeers(enabled bool) BlockPoolOption {
+	return func(pool *BlockPool) { pool.autoRemoveSlowPeers = enabled }
+}
+
+// WithStandbyPeers makes each requester pick a standby peer along with the one
+// it requests the block from. If the request times out or the peer fails, the
+// block is requested from the standby right away instead of picking a peer
+// again. A standby takes up one of the peer's maxPendingRequestsPerPeer slots,
+// but isn't sent anything until it's used. Pinned heights have no standby.
+// Defaults to false.
+func WithStandbyPeers(enabled bool) BlockPoolOption {
+	return func(pool *BlockPool) { pool.standbyPeers = enabled }
+}
+
+// WithMaxUnexpectedBlockDiff sets how far from the pool's height a block we
+// didn't request may be before the peer which sent it is reported. Blocks
+// closer than that are most likely late responses to redone requests. With a
+// big prefetch window (see WithPrefetchAhead) late blocks can be farther off.
+// Zero disables the check. Defaults to 100.
+func WithMaxUnexpectedBlockDiff(n int64) BlockPoolOption {
+	return func(pool *BlockPool) { pool.maxUnexpectedBlockDiff = n }
+}
+
+// WithMaxPeerHeightLead sets how far above the highest height reported by the
+// other peers, or the pool's height if it's higher, a peer may claim to be.
+// Ranges beyond that are ignored, so that a peer claiming an absurd height
+// can't make itself eligible for every request. The peer is accepted once
+// other peers catch up. Without other peers there's nothing to compare with,
+// so any height is accepted; a fresh node is usually far behind the network.
+// Zero disables the check, which is the default.
+func WithMaxPeerHeightLead(n int64) BlockPoolOption {
+	return func(pool *BlockPool) { pool.maxPeerHeightLead = n }
+}
+
+// WithMaxPeerRangeSpan sets the maximum number of heights, height-base, a
+// peer may claim to have. Ranges spanning more are ignored, which bounds a
+// peer claiming base=0 and an absurd height even when it's the first peer,
+// see WithMaxPeerHeightLead. It must be set above the chain's height if
+// archive peers are to be used. Zero disables the check, which is the default.
+func WithMaxPeerRangeSpan(n int64) BlockPoolOption {
+	return func(pool *BlockPool) { pool.maxPeerRangeSpan = n }
+}
+
+// WithLogDedup makes the pool log an error only the first time it occurs for a
+// peer. Repeats of it, i.e. with the same message, error type and peer, are
+// logged at debug level, and how many there were is logged every interval,
+// after which the error is logged in full again. It keeps mass failures from
+// flooding the logs. It applies to loggers set after the pool is created.
+// Zero disables it, which is the default.
+func WithLogDedup(interval time.Duration) BlockPoolOption {
+	return func(pool *BlockPool) { pool.logDedupInterval = interval }
+}
+
+// WithSamePeerRetries makes a requester whose request timed out request the
+// block again from the same peer, after delay, up to n times before it picks
+// another peer. It helps with good peers on flaky links, which would otherwise
+// lose the height on every dropped request. The count is reset once the block
+// arrives. Defaults to 0, i.e. another peer is picked right away.
+func WithSamePeerRetries(n int, delay time.Duration) BlockPoolOption {
+	return func(pool *BlockPool) {
+		pool.samePeerRetries = n
+		pool.samePeerRetryDelay = delay
+	}
+}
+
+// WithPeerSelector sets the strategy used to pick a peer to request a block
+// from. Defaults to DefaultSelector.
+func WithPeerSelector(selector PeerSelector) BlockPoolOption {
+	return func(pool *BlockPool) { pool.peerSelector = selector }
+}
+
+// WithCaughtUpChecks sets the number of consecutive IsCaughtUp calls which
+// must find the node caught up before it reports so. Defaults to 1.
+func WithCaughtUpChecks(n int) BlockPoolOption {
+	return func(pool *BlockPool) { pool.minCaughtUpChecks = n }
+}
+
+// CommitVerifier verifies a block using the commit for it from the next block.
+type CommitVerifier func(block *types.Block, commitFromNext *types.Commit) error
+
+// WithCommitVerifier makes PopRequest verify the block before popping it.
+func WithCommitVerifier(verifier CommitVerifier) BlockPoolOption {
+	return func(pool *BlockPool) { pool.commitVerifier = verifier }
+}
+
+// WithOnBlockPopped sets a callback which PopRequest calls with every block it
+// pops, in order, right before the pool's height advances. It's called
+// synchronously with the pool's lock held, so a slow callback slows down the
+// sync and should offload any heavy work. It must not call the pool.
+func WithOnBlockPopped(f func(*types.Block)) BlockPoolOption {
+	return func(pool *BlockPool) { pool.onBlockPopped = f }
+}
+
+// WithSyncRateHistorySize sets the number of per-window sync rates returned by
+// SyncRateHistory. Defaults to 10.
+func WithSyncRateHistorySize(n int) BlockPoolOption {
+	return func(pool *BlockPool) { pool.syncRateHistorySize = n }
+}
+
+// WithDeliveryAuditSize sets the number of popped heights returned by
+// DeliveryAudit. Zero disables the audit. Defaults to 1000.
+func WithDeliveryAuditSize(n int) BlockPoolOption {
+	return func(pool *BlockPool) { pool.deliveryAuditSize = n }
+}
+
+// WithMaxBlockBytes sets the maximum size of a block. Bigger blocks are
+// dropped, the peer which sent them is reported and the block is requested
+// again. Zero (the default) means no limit.
+func WithMaxBlockBytes(n int) BlockPoolOption {
+	return func(pool *BlockPool) { pool.maxBlockBytes = n }
+}
+
+// WithMaxDeliveryReorder makes the pool report a peer which delivers a block
+// more than n heights below the highest one it delivered before. Blocks are
+// requested from a peer in increasing order, mostly, so a peer going far back
+// may be replaying old responses. The block is discarded and requested again.
+// Zero (the default) disables the check.
+func WithMaxDeliveryReorder(n int64) BlockPoolOption {
+	return func(pool *BlockPool) { pool.maxDeliveryReorder = n }
+}
+
+// PeerAdmission is the decision of an OnPeerAdd callback on a new peer.
+type PeerAdmission int
+
+const (
+	// PeerAccepted adds the peer.
+	PeerAccepted PeerAdmission = iota
+	// PeerRefused ignores the peer, until it reports its range again.
+	PeerRefused
+	// PeerUntrusted adds the peer, so its height counts, but it's never picked
+	// to serve a block (see WhyNotEligible), not even for the heights pinned to
+	// it.
+	PeerUntrusted
+)
+
+// WithOnPeerAdd sets a callback which vets every new peer before it's added,
+// e.g. to check peers against an allowlist or to request blocks only from the
+// ones which passed a stricter handshake policy. It's called once per peer,
+// with the pool's lock held, so it must not call into the pool.
+func WithOnPeerAdd(f func(peerID p2p.ID, base, height int64) PeerAdmission) BlockPoolOption {
+	return func(pool *BlockPool) { pool.onPeerAdd = f }
+}
+
+// WithOnNoPeers sets a callback called when the last peer is removed before
+// the pool has caught up. Sync stalls until a peer is added, so the reactor
+// may want to dial more peers or switch modes. It's called with the pool's
+// lock held, so it must not call into the pool.
+func WithOnNoPeers(f func()) BlockPoolOption {
+	return func(pool *BlockPool) { pool.onNoPeers = f }
+}
+
+// WithOnRequesterReassigned sets a callback called whenever the block at a
+// height is requested from a different peer than before, e.g. because the
+// previous peer was removed. Frequent reassignments of a height explain why
+// it's slow to arrive. It's called from the requester's goroutine.
+func WithOnRequesterReassigned(f func(height int64, from, to p2p.ID)) BlockPoolOption {
+	return func(pool *BlockPool) { pool.onRequesterReassigned = f }
+}
+
+// WithRequesterWorkers makes n workers request the blocks of all requesters,
+// instead of every requester running its own goroutine. A requester waiting
+// for its block then costs a timer rather than a goroutine, which matters on
+// low-resource nodes as there may be up to maxTotalRequesters of them. Zero
+// (the default) means a goroutine per requester.
+func WithRequesterWorkers(n int) BlockPoolOption {
+	return func(pool *BlockPool) { pool.requesterWorkers = n }
+}
+
+// BlockProvider returns the block at the given height.
+type BlockProvider func(height int64) (*types.Block, error)
+
+// WithBlockProvider makes the pool get blocks from provider instead of
+// requesting them on requestsCh, turning it into a deterministic block source
+// for testing the components downstream without a network. Peers must still
+// be added with SetPeerRange; each block is attributed to the peer picked to
+// serve its height. If provider fails, the block is retried after the request
+// timeout.
+//
+// NOTE: for tests only.
+func WithBlockProvider(provider BlockProvider) BlockPoolOption {
+	return func(pool *BlockPool) { pool.blockProvider = provider }
+}
+
+// WithJitterSource sets the source of the random numbers, in [0, 1), used to
+// jitter peer timeouts. Defaults to tmrand.Float64. Mostly useful to make
+// tests deterministic.
+func WithJitterSource(f func() float64) BlockPoolOption {
+	return func(pool *BlockPool) { pool.jitterSource = f }
+}
+
+// PoolOptions is the effective configuration of a pool, i.e. the values set by
+// the BlockPoolOptions it was created with or their defaults. Callbacks and
+// other hooks aren't included.
+type PoolOptions struct {
+	ShutdownTimeout        time.Duration
+	MaxStalledBlocks       int
+	RateLimitingDisabled   bool
+	MaxPeers               int
+	EvictionPolicy         EvictionPolicy
+	PeerEventLogLevel      string
+	MaxStoredBlocks        int
+	PrefetchAhead          int64
+	EndHeight              int64
+	HeightDecreasePolicy   HeightDecreasePolicy
+	ErrorWindow            time.Duration
+	ErrorBurst             int
+	HeadPriority           bool
+	TrustedMaxPeerHeight   bool
+	DebugStringMaxHeights  int
+	RateCheckGracePeriod   time.Duration
+	RecvRateSeed           float64
+	SlowPeerProbation      time.Duration
+	AutoRemoveSlowPeers    bool
+	StandbyPeers           bool
+	MaxUnexpectedBlockDiff int64
+	MaxPeerHeightLead      int64
+	MaxPeerRangeSpan       int64
+	LogDedupInterval       time.Duration
+	MaxDeliveryReorder     int64
+	RequesterWorkers       int
+	MaxBlockBytes          int
+	CaughtUpChecks         int
+	SyncRateHistorySize    int
+	DeliveryAuditSize      int
+	ChannelWatchdog        time.Duration // see SetChannelWatchdog
+	SamePeerRetries        int
+	SamePeerRetryDelay     time.Duration
+}
+
+// Options returns the pool's effective configuration, with defaults filled in,
+// e.g. to show the active tuning on a status endpoint.
+func (pool *BlockPool) Options() PoolOptions {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	return PoolOptions{
+		ShutdownTimeout:        pool.shutdownTimeout,
+		MaxStalledBlocks:       pool.maxStalledBlocks,
+		RateLimitingDisabled:   pool.disableRateLimiting,
+		MaxPeers:               pool.maxPeers,
+		EvictionPolicy:         pool.evictionPolicy,
+		PeerEventLogLevel:      pool.peerEventLogLevel,
+		MaxStoredBlocks:        pool.maxStoredBlocks,
+		PrefetchAhead:          pool.prefetchAhead,
+		EndHeight:              pool.endHeight,
+		HeightDecreasePolicy:   pool.heightDecreasePolicy,
+		ErrorWindow:            pool.errorWindow,
+		ErrorBurst:             pool.errorBurst,
+		HeadPriority:           pool.headPriority,
+		TrustedMaxPeerHeight:   pool.trustedMaxPeerHeight,
+		DebugStringMaxHeights:  pool.debugStringMaxHeights,
+		RateCheckGracePeriod:   pool.rateCheckGracePeriod,
+		RecvRateSeed:           pool.recvRateSeed,
+		SlowPeerProbation:      pool.slowPeerProbation,
+		AutoRemoveSlowPeers:    pool.autoRemoveSlowPeers,
+		StandbyPeers:           pool.standbyPeers,
+		MaxUnexpectedBlockDiff: pool.maxUnexpectedBlockDiff,
+		MaxPeerHeightLead:      pool.maxPeerHeightLead,
+		MaxPeerRangeSpan:       pool.maxPeerRangeSpan,
+		LogDedupInterval:       pool.logDedupInterval,
+		MaxDeliveryReorder:     pool.maxDeliveryReorder,
+		RequesterWorkers:       pool.requesterWorkers,
+		MaxBlockBytes:          pool.maxBlockBytes,
+		CaughtUpChecks:         pool.minCaughtUpChecks,
+		SyncRateHistorySize:    pool.syncRateHistorySize,
+		DeliveryAuditSize:      pool.deliveryAuditSize,
+		ChannelWatchdog:        pool.watchdogInterval,
+		SamePeerRetries:        pool.samePeerRetries,
+		SamePeerRetryDelay:     pool.samePeerRetryDelay,
+	}
 }
 
 // OnStart implements service.Service by spawning requesters routine and recording
 // pool's start time.
 func (pool *BlockPool) OnStart() error {
-	go pool.makeRequestersRoutine()
+	pool.spawn("makeRequestersRoutine", pool.makeRequestersRoutine)
+	for i := 0; i < pool.requesterWorkers; i++ {
+		pool.spawnRequesterRoutine(fmt.Sprintf("requesterWorker(%d)", i), pool.requesterWorker)
+	}
+	if pool.watchdogInterval > 0 {
+		pool.spawn("channelWatchdog", pool.channelWatchdog)
+	}
+	if pool.logDedupInterval > 0 {
+		pool.spawn("logDedupRoutine", pool.logDedupRoutine)
+	}
+	pool.mtx.Lock()
 	pool.startTime = time.Now()
+	pool.lastWindowTime = pool.startTime
+	pool.mtx.Unlock()
+	if pool.ctx != nil {
+		// not spawned, as OnStop may wait for the spawned goroutines.
+		go pool.stopOnContextDone()
+	}
 	return nil
 }
 
+func (pool *BlockPool) stopOnContextDone() {
+	select {
+	case <-pool.ctx.Done():
+		pool.Logger.Info("Context done, stopping", "err", pool.ctx.Err())
+		if err := pool.Stop(); err != nil && err != service.ErrAlreadyStopped {
+			pool.Logger.Error("Error stopping pool", "err", err)
+		}
+	case <-pool.Quit():
+	}
+}
+
+// SetLogger sets the pool's logger, wrapped to drop repeated errors if
+// WithLogDedup is enabled.
+func (pool *BlockPool) SetLogger(l log.Logger) {
+	if pool.logDedupInterval > 0 {
+		l = newDedupLogger(l)
+	}
+	pool.BaseService.SetLogger(l)
+}
+
+// OnStop implements service.Service. It closes the channels returned by
+// TraceHeight. If a shutdown timeout is configured, it stops all requesters
+// and waits up to that long for the goroutines to exit.
+func (pool *BlockPool) OnStop() {
+	close(pool.stopCh)
+	pool.closeAllTraces()
+
+	if pool.shutdownTimeout <= 0 {
+		return
+	}
+
+	pool.mtx.Lock()
+	for _, requester := range pool.requesters {
+		if err := requester.Stop(); err != nil && err != service.ErrAlreadyStopped {
+			pool.Logger.Error("Error stopping requester", "err", err)
+		}
+	}
+	pool.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		pool.routinesWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(pool.shutdownTimeout):
+		pool.Logger.Error("Timed out waiting for goroutines to exit",
+			"timeout", pool.shutdownTimeout, "alive", pool.aliveRoutines())
+	}
+}
+
+// spawn runs f in a new goroutine, which OnStop can wait for.
+func (pool *BlockPool) spawn(name string, f func()) {
+	pool.routinesMtx.Lock()
+	pool.routines[name]++
+	pool.routinesMtx.Unlock()
+
+	pool.routinesWg.Add(1)
+	go func() {
+		defer func() {
+			pool.routinesMtx.Lock()
+			pool.routines[name]--
+			if pool.routines[name] == 0 {
+				delete(pool.routines, name)
+			}
+			pool.routinesMtx.Unlock()
+			pool.routinesWg.Done()
+		}()
+		f()
+	}()
+}
+
+// Spawns a goroutine serving requesters, see NumRequesterGoroutines.
+func (pool *BlockPool) spawnRequesterRoutine(name string, f func()) {
+	atomic.AddInt32(&pool.numRequesterRoutines, 1)
+	pool.spawn(name, func() {
+		defer atomic.AddInt32(&pool.numRequesterRoutines, -1)
+		f()
+	})
+}
+
+// NumRequesterGoroutines returns the number of live goroutines serving
+// requesters: one per requester or, with WithRequesterWorkers, the workers.
+// It should drop to zero once the pool is stopped; if it doesn't, goroutines
+// are leaking.
+func (pool *BlockPool) NumRequesterGoroutines() int {
+	return int(atomic.LoadInt32(&pool.numRequesterRoutines))
+}
+
+// aliveRoutines returns the sorted names of goroutines that haven't exited
+// yet, once per goroutine.
+func (pool *BlockPool) aliveRoutines() []string {
+	pool.routinesMtx.Lock()
+	defer pool.routinesMtx.Unlock()
+
+	names := make([]string, 0, len(pool.routines))
+	for name, n := range pool.routines {
+		for i := 0; i < n; i++ {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 // spawns requesters as needed
 func (pool *BlockPool) makeRequestersRoutine() {
 	for {
@@ -123,33 +954,87 @@ func (pool *BlockPool) makeRequestersRoutine() {
 			time.Sleep(requestIntervalMS * time.Millisecond)
 			// check for timed out peers
 			pool.removeTimedoutPeers()
+		case pool.IsPaused():
+			time.Sleep(requestIntervalMS * time.Millisecond)
+			pool.removeTimedoutPeers()
+		case pool.isConsumerBehind(lenRequesters - int(numPending)):
+			// wait for the consumer to pop some blocks.
+			time.Sleep(requestIntervalMS * time.Millisecond)
+			pool.removeTimedoutPeers()
 		default:
 			// request for more blocks.
-			pool.makeNextRequester()
+			if !pool.makeNextRequester() {
+				// nothing to request yet; don't hog the lock, so that the
+				// requesters of the blocks we wait on can pick a peer.
+				time.Sleep(requestIntervalMS * time.Millisecond)
+			}
 		}
 	}
 }
 
+// Pause stops the pool from making new requesters, e.g. while the network is
+// known to be unreliable. Existing requesters keep requesting their blocks.
+func (pool *BlockPool) Pause() {
+	atomic.StoreUint32(&pool.paused, 1)
+}
+
+// Resume undoes Pause.
+func (pool *BlockPool) Resume() {
+	atomic.StoreUint32(&pool.paused, 0)
+}
+
+// IsPaused returns true if the pool is paused (see Pause).
+func (pool *BlockPool) IsPaused() bool {
+	return atomic.LoadUint32(&pool.paused) == 1
+}
+
+// Returns true if the pool stores too many blocks, given the number of
+// requesters which already have one. Logs when the consumer falls behind.
+func (pool *BlockPool) isConsumerBehind(numStored int) bool {
+	behind := pool.maxStoredBlocks > 0 && numStored >= pool.maxStoredBlocks
+	if behind && !pool.consumerBehind {
+		pool.Logger.Info("Pausing block requests",
+			"err", ErrConsumerBehind{NumStored: numStored, MaxStored: pool.maxStoredBlocks})
+	}
+	pool.consumerBehind = behind
+	return behind
+}
+
 func (pool *BlockPool) removeTimedoutPeers() {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
 	for _, peer := range pool.peers {
-		if !peer.didTimeout && peer.numPending > 0 {
+		if !peer.didTimeout && peer.numPending > 0 && !pool.disableRateLimiting &&
+			time.Since(peer.addedAt) >= pool.rateCheckGracePeriod &&
+			time.Now().After(peer.probationUntil) {
 			curRate := peer.recvMonitor.Status().CurRate
 			// curRate can be 0 on start
-			if curRate != 0 && curRate < minRecvRate {
+			switch {
+			case curRate == 0 || curRate >= minRecvRate:
+				if !peer.probationUntil.IsZero() {
+					pool.logPeerEvent(peerEventRecovered, peer.id, "curRate", fmt.Sprintf("%d B/s", curRate))
+					peer.probationUntil = time.Time{}
+				}
+			case pool.slowPeerProbation > 0 && peer.probationUntil.IsZero():
+				peer.probationUntil = time.Now().Add(pool.slowPeerProbation)
+				peer.resetMonitor()
+				pool.logPeerEvent(peerEventProbation, peer.id,
+					"curRate", fmt.Sprintf("%d B/s", curRate),
+					"minRate", fmt.Sprintf("%d B/s", minRecvRate),
+					"until", peer.probationUntil)
+			default:
 				err := errors.New("peer is not sending us data fast enough")
-				pool.sendError(err, peer.id)
-				pool.Logger.Error("SendTimeout", "peer", peer.id,
+				pool.sendError(err, peer.id, PeerErrorTooSlow)
+				pool.logPeerEvent(peerEventTimedOut, peer.id,
 					"reason", err,
-					"curRate", fmt.Sprintf("%d KB/s", curRate/1024),
-					"minRate", fmt.Sprintf("%d KB/s", minRecvRate/1024))
+					"curRate", fmt.Sprintf("%d B/s", curRate),
+					"minRate", fmt.Sprintf("%d B/s", minRecvRate))
 				peer.didTimeout = true
 			}
 		}
-		if peer.didTimeout {
-			pool.removePeer(peer.id)
+		if peer.didTimeout && pool.autoRemoveSlowPeers {
+			pool.removePeer(peer.id, "timed out")
 		}
 	}
 }
@@ -163,12 +1048,52 @@ func (pool *BlockPool) GetStatus() (height int64, numPending int32, lenRequester
 	return pool.height, atomic.LoadInt32(&pool.numPending), len(pool.requesters)
 }
 
+// StartedAt returns when the pool was started, or the zero time if it hasn't
+// been.
+func (pool *BlockPool) StartedAt() time.Time {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	return pool.startTime
+}
+
+// Uptime returns how long ago the pool was started, or zero if it hasn't been.
+// Along with TotalBytesDownloaded, it gives the average throughput of the
+// session.
+func (pool *BlockPool) Uptime() time.Duration {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	if pool.startTime.IsZero() {
+		return 0
+	}
+	return time.Since(pool.startTime)
+}
+
 // IsCaughtUp returns true if this node is caught up, false - otherwise.
+// If WithCaughtUpChecks is set, it returns true only after the node has been
+// caught up for that many consecutive calls, so that a height oscillating
+// around maxPeerHeight-1 doesn't make it flap.
 // TODO: relax conditions, prevent abuse.
 func (pool *BlockPool) IsCaughtUp() bool {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
+	isCaughtUp := pool.isCaughtUp()
+	if pool.wasCaughtUp && !isCaughtUp {
+		pool.numCaughtUpFlaps++
+	}
+	pool.wasCaughtUp = isCaughtUp
+
+	if isCaughtUp {
+		pool.numCaughtUpChecks++
+	} else {
+		pool.numCaughtUpChecks = 0
+	}
+	return pool.numCaughtUpChecks >= pool.minCaughtUpChecks
+}
+
+func (pool *BlockPool) isCaughtUp() bool {
 	// Need at least 1 peer to be considered caught up.
 	if len(pool.peers) == 0 {
 		pool.Logger.Debug("Blockpool has no peers")
@@ -181,21 +1106,36 @@ func (pool *BlockPool) IsCaughtUp() bool {
 	// Note we use maxPeerHeight - 1 because to sync block H requires block H+1
 	// to verify the LastCommit.
 	receivedBlockOrTimedOut := pool.height > 0 || time.Since(pool.startTime) > 5*time.Second
-	ourChainIsLongestAmongPeers := pool.maxPeerHeight == 0 || pool.height >= (pool.maxPeerHeight-1)
+	if pool.trustedMaxPeerHeight {
+		receivedBlockOrTimedOut = pool.trustedPeerHeight > 0 || time.Since(pool.startTime) > 5*time.Second
+	}
+	maxPeerHeight := pool.targetHeight()
+	ourChainIsLongestAmongPeers := maxPeerHeight == 0 || pool.height >= (maxPeerHeight-1)
 	isCaughtUp := receivedBlockOrTimedOut && ourChainIsLongestAmongPeers
 	return isCaughtUp
 }
 
+// CaughtUpFlaps returns how many times the node went from being caught up
+// to not being caught up, as seen by IsCaughtUp.
+func (pool *BlockPool) CaughtUpFlaps() int {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	return pool.numCaughtUpFlaps
+}
+
 // PeekTwoBlocks returns blocks at pool.height and pool.height+1.
 // We need to see the second block's Commit to validate the first block.
 // So we peek two blocks at a time.
 // The caller will verify the commit.
-func (pool *BlockPool) PeekTwoBlocks() (first *types.Block, second *types.Block) {
+// firstCommit is the commit for the first block received through AddCommit, if
+// any. With it the first block can be verified without waiting for the second.
+func (pool *BlockPool) PeekTwoBlocks() (first *types.Block, second *types.Block, firstCommit *types.Commit) {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
 	if r := pool.requesters[pool.height]; r != nil {
-		first = r.getBlock()
+		first, firstCommit = r.getBlockAndCommit()
 	}
 	if r := pool.requesters[pool.height+1]; r != nil {
 		second = r.getBlock()
@@ -203,9 +1143,43 @@ func (pool *BlockPool) PeekTwoBlocks() (first *types.Block, second *types.Block)
 	return
 }
 
+// AddCommit pairs a commit with the block received for height. The commit must
+// be for that very block; otherwise the peer is reported. Commits arriving
+// before their block are dropped, and a redo drops the commit along with the
+// block. See PeekTwoBlocks.
+func (pool *BlockPool) AddCommit(peerID p2p.ID, height int64, commit *types.Commit) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	if commit == nil || commit.Height != height {
+		pool.sendError(errors.New("commit height doesn't match requested height"),
+			peerID, PeerErrorBlockMismatch)
+		return
+	}
+
+	requester := pool.requesters[height]
+	if requester == nil {
+		pool.Logger.Debug("peer sent us a commit we didn't expect", "peer", peerID, "height", height)
+		return
+	}
+
+	if !requester.setCommit(commit) {
+		block := requester.getBlock()
+		if block == nil {
+			pool.Logger.Debug("no block to pair the commit with yet", "peer", peerID, "height", height)
+			return
+		}
+		pool.sendError(fmt.Errorf("commit for block %v doesn't match block %v at height %d",
+			commit.BlockID.Hash, block.Hash(), height), peerID, PeerErrorBlockMismatch)
+	}
+}
+
 // PopRequest pops the first block at pool.height.
-// It must have been validated by 'second'.Commit from PeekTwoBlocks().
-func (pool *BlockPool) PopRequest() {
+// It must have been validated by 'second'.Commit from PeekTwoBlocks(), unless
+// a CommitVerifier is set (see WithCommitVerifier). In that case, PopRequest
+// runs it first and, if the block is rejected, redoes its request and returns
+// the error without advancing.
+func (pool *BlockPool) PopRequest() error {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
@@ -215,38 +1189,481 @@ func (pool *BlockPool) PopRequest() {
 			PanicSanity("PopRequest() requires a valid block")
 		}
 		*/
+		if err := pool.verifyCommit(r); err != nil {
+			return err
+		}
 		if err := r.Stop(); err != nil {
 			pool.Logger.Error("Error stopping requester", "err", err)
 		}
+		if block := r.getBlock(); block != nil {
+			pool.traceHeight(HeightValidated, pool.height, r.getPeerID())
+			pool.auditDelivery(r)
+			pool.poppedBytes += int64(r.getBlockSize())
+			pool.numPoppedBlocks++
+			if pool.onBlockPopped != nil {
+				pool.onBlockPopped(block)
+			}
+			pool.traceHeight(HeightPopped, pool.height, r.getPeerID())
+		}
 		delete(pool.requesters, pool.height)
+		delete(pool.pinned, pool.height)
+		pool.closeTraces(pool.height)
 		pool.height++
+		pool.updateSyncRate()
 	} else {
 		panic(fmt.Sprintf("Expected requester to pop, got nothing at height %v", pool.height))
 	}
+	return nil
 }
 
-// RedoRequest invalidates the block at pool.height,
-// Remove the peer and redo request from others.
-// Returns the ID of the removed peer.
-func (pool *BlockPool) RedoRequest(height int64) p2p.ID {
+// Runs the commit verifier, if any, on the block of the given requester and
+// the commit from the next block. Redoes the request if verification fails.
+func (pool *BlockPool) verifyCommit(r *bpRequester) error {
+	if pool.commitVerifier == nil {
+		return nil
+	}
+
+	block := r.getBlock()
+	if block == nil {
+		return fmt.Errorf("no block to verify at height %d", r.height)
+	}
+	next := pool.requesters[r.height+1]
+	if next == nil || next.getBlock() == nil {
+		return fmt.Errorf("no commit to verify block %d with", r.height)
+	}
+
+	if err := pool.commitVerifier(block, next.getBlock().LastCommit); err != nil {
+		peerID := pool.redoRequest(r.height)
+		err = fmt.Errorf("block %d from peer %v failed verification: %w", r.height, peerID, err)
+		if peerID != "" {
+			pool.sendError(err, peerID, PeerErrorBadBlock)
+		}
+		return err
+	}
+	return nil
+}
+
+// Recomputes the sync rate at the end of every window of popped blocks.
+func (pool *BlockPool) updateSyncRate() {
+	pool.numPopped++
+	if pool.numPopped%syncRateWindow != 0 {
+		return
+	}
+
+	rate := syncRateWindow / time.Since(pool.lastWindowTime).Seconds()
+	if pool.syncRateHistorySize > 0 {
+		pool.syncRateHistory = append(pool.syncRateHistory, rate)
+		if len(pool.syncRateHistory) > pool.syncRateHistorySize {
+			pool.syncRateHistory = pool.syncRateHistory[1:]
+		}
+	}
+	if pool.lastSyncRate == 0 {
+		pool.lastSyncRate = rate
+	} else {
+		pool.lastSyncRate = 0.9*pool.lastSyncRate + 0.1*rate
+	}
+	pool.lastWindowTime = time.Now()
+}
+
+// SyncRate returns the rate at which blocks are popped from the pool in blocks
+// per second, smoothed with an exponential moving average over windows of 100
+// blocks. It returns 0 until the first window completes.
+func (pool *BlockPool) SyncRate() float64 {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
-	request := pool.requesters[height]
-	peerID := request.getPeerID()
-	if peerID != p2p.ID("") {
-		// RemovePeer will redo all requesters associated with this peer.
-		pool.removePeer(peerID)
+	return pool.lastSyncRate
+}
+
+// ThroughputMBps returns the rate at which blocks are popped from the pool in
+// megabytes (10^6 bytes) per second, i.e. SyncRate times the average size of
+// the blocks popped so far. It returns 0 until the first window completes.
+func (pool *BlockPool) ThroughputMBps() float64 {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	if pool.numPoppedBlocks == 0 {
+		return 0
 	}
-	return peerID
+	avgBlockSize := float64(pool.poppedBytes) / float64(pool.numPoppedBlocks)
+	return pool.lastSyncRate * avgBlockSize / 1e6
 }
 
-// AddBlock validates that the block comes from the peer it was expected from and calls the requester to store it.
-// TODO: ensure that blocks come in order for each peer.
-func (pool *BlockPool) AddBlock(peerID p2p.ID, block *types.Block, blockSize int) {
+// BlockSizeStats returns the minimum, maximum and average size in bytes of the
+// last 100 blocks delivered by peers. Times the number of requesters (see
+// WithPrefetchAhead), it bounds how much memory the pool may hold in blocks.
+// All are 0 until a block is delivered.
+func (pool *BlockPool) BlockSizeStats() (min, max, avg int) {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
+	if pool.numBlockSizes == 0 {
+		return 0, 0, 0
+	}
+	min, max = pool.blockSizes[0], pool.blockSizes[0]
+	total := 0
+	for _, size := range pool.blockSizes[:pool.numBlockSizes] {
+		if size < min {
+			min = size
+		}
+		if size > max {
+			max = size
+		}
+		total += size
+	}
+	return min, max, total / pool.numBlockSizes
+}
+
+func (pool *BlockPool) sampleBlockSize(size int) {
+	pool.blockSizes[pool.nextBlockSize] = size
+	pool.nextBlockSize = (pool.nextBlockSize + 1) % blockSizeSamples
+	if pool.numBlockSizes < blockSizeSamples {
+		pool.numBlockSizes++
+	}
+}
+
+// EstimatedTimeRemaining returns how long it will take to pop the blocks up
+// to the highest peer height at the current sync rate. The second value is
+// false if there's no rate estimate yet, see SyncRate.
+func (pool *BlockPool) EstimatedTimeRemaining() (time.Duration, bool) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	return pool.estimatedTimeRemaining()
+}
+
+// EstimatedCompletionTime returns when the pool will have popped the blocks up
+// to the highest peer height, as estimated by EstimatedTimeRemaining.
+func (pool *BlockPool) EstimatedCompletionTime() (time.Time, bool) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	remaining, ok := pool.estimatedTimeRemaining()
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Now().Add(remaining), true
+}
+
+// Assumes the lock is held.
+func (pool *BlockPool) estimatedTimeRemaining() (time.Duration, bool) {
+	if pool.lastSyncRate <= 0 {
+		return 0, false
+	}
+	remaining := pool.targetHeight() - pool.height
+	if remaining <= 0 {
+		return 0, true
+	}
+	return time.Duration(float64(remaining) / pool.lastSyncRate * float64(time.Second)), true
+}
+
+// SyncRateHistory returns the raw, unsmoothed sync rates of the last windows
+// of 100 popped blocks, oldest first. A steady decline points to a slow peer,
+// while noisy rates are usually harmless.
+func (pool *BlockPool) SyncRateHistory() []float64 {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	history := make([]float64, len(pool.syncRateHistory))
+	copy(history, pool.syncRateHistory)
+	return history
+}
+
+// DeliveryRecord tells which peer delivered the block accepted for a height.
+type DeliveryRecord struct {
+	Height int64
+	PeerID p2p.ID
+	// times the block was requested again, e.g. because it was invalid or
+	// the peer timed out
+	NumRedos int
+}
+
+// DeliveryAudit returns the records of the last popped heights, oldest first.
+// Unlike the live stats, it's an after the fact record of who served the
+// blocks which were actually accepted.
+func (pool *BlockPool) DeliveryAudit() []DeliveryRecord {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	audit := make([]DeliveryRecord, len(pool.deliveryAudit))
+	copy(audit, pool.deliveryAudit)
+	return audit
+}
+
+// Assumes the lock is held.
+func (pool *BlockPool) auditDelivery(r *bpRequester) {
+	if pool.deliveryAuditSize <= 0 {
+		return
+	}
+	peerID, numRedos := r.getDelivery()
+	pool.deliveryAudit = append(pool.deliveryAudit, DeliveryRecord{
+		Height:   r.height,
+		PeerID:   peerID,
+		NumRedos: numRedos,
+	})
+	if len(pool.deliveryAudit) > pool.deliveryAuditSize {
+		pool.deliveryAudit = pool.deliveryAudit[1:]
+	}
+}
+
+// Progress returns the fraction, in [0, 1], of the blocks between the start
+// height and the highest height reported by peers which have been popped.
+// It returns 1 if the pool is already at or above that height.
+func (pool *BlockPool) Progress() float64 {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	maxPeerHeight := pool.targetHeight()
+	if pool.height >= maxPeerHeight {
+		return 1
+	}
+	if maxPeerHeight <= pool.startHeight {
+		return 1
+	}
+	progress := float64(pool.height-pool.startHeight) / float64(maxPeerHeight-pool.startHeight)
+	if progress < 0 {
+		return 0
+	}
+	return progress
+}
+
+// CancelRequest stops the requester for the given height and removes it
+// without advancing the pool's height. It's a no-op if there's no such
+// requester. A block which arrives later for this height is ignored.
+//
+// NOTE: makeNextRequester fills gaps first, so if the height is still within
+// the range of any peer, a new requester will shortly be made for it.
+func (pool *BlockPool) CancelRequest(height int64) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	r := pool.requesters[height]
+	if r == nil {
+		return
+	}
+	pool.removeRequester(r)
+}
+
+// Stops the requester and removes it, releasing its pending request, if any.
+func (pool *BlockPool) removeRequester(r *bpRequester) {
+	if err := r.Stop(); err != nil {
+		pool.Logger.Error("Error stopping requester", "err", err)
+	}
+	delete(pool.requesters, r.height)
+	pool.releaseStandbyPeer(r)
+
+	if r.getBlock() == nil {
+		atomic.AddInt32(&pool.numPending, -1)
+		if peer := pool.peers[r.getPeerID()]; peer != nil && peer.numPending > 0 {
+			peer.decrPending(0)
+		}
+	}
+}
+
+// InjectBlock fills the given height with a block obtained some other way,
+// e.g. from a trusted snapshot, without requesting it from a peer. A pending
+// request for the height is cancelled, and a block which already arrived for it
+// is replaced. The block is popped in order, like one delivered by a peer.
+// Blocks may be injected before the pool is started, so it starts requesting
+// right above them.
+//
+// It returns an error if the pool is stopped, the block is nil or isn't for
+// the given height, or the height is below the pool's height or beyond the
+// heights the pool would request.
+func (pool *BlockPool) InjectBlock(height int64, block *types.Block) error {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	select {
+	case <-pool.stopCh:
+		return errors.New("pool is stopped")
+	default:
+	}
+	if block == nil {
+		return errors.New("nil block")
+	}
+	if block.Height != height {
+		return fmt.Errorf("block height %d doesn't match height %d", block.Height, height)
+	}
+	if height < pool.height || pool.beyondRequestWindow(height) {
+		return fmt.Errorf("height %d is outside of the requested range starting at %d", height, pool.height)
+	}
+
+	if r := pool.requesters[height]; r != nil {
+		pool.removeRequester(r)
+	}
+	r := newBPRequester(pool, height)
+	r.block = block
+	r.blockSize = block.Size()
+	pool.requesters[height] = r
+	if err := r.Start(); err != nil {
+		delete(pool.requesters, height)
+		return fmt.Errorf("starting requester for height %d: %w", height, err)
+	}
+	pool.traceHeight(HeightBlockReceived, height, "")
+	pool.Logger.Info("Injected block", "height", height)
+	return nil
+}
+
+// SkipHeight advances the pool past the given height without a block. It's
+// meant for recovery only, when no peer can serve the height (e.g. all of them
+// pruned it) and the block will be obtained some other way. The skipped heights
+// are returned by SkippedHeights.
+//
+// It returns an error unless height is the pool's height and its block hasn't
+// arrived (otherwise, use PopRequest).
+func (pool *BlockPool) SkipHeight(height int64) error {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	if height != pool.height {
+		return fmt.Errorf("can only skip height %d, not %d", pool.height, height)
+	}
+	if r := pool.requesters[height]; r != nil {
+		if r.getBlock() != nil {
+			return fmt.Errorf("block %d has arrived, pop it instead", height)
+		}
+		pool.removeRequester(r)
+	}
+
+	pool.Logger.Error("SKIPPING BLOCK: the block must be obtained some other way", "height", height)
+	delete(pool.pinned, height)
+	pool.closeTraces(height)
+	pool.skippedHeights = append(pool.skippedHeights, height)
+	pool.height++
+	return nil
+}
+
+// SkippedHeights returns the heights skipped with SkipHeight.
+func (pool *BlockPool) SkippedHeights() []int64 {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	skipped := make([]int64, len(pool.skippedHeights))
+	copy(skipped, pool.skippedHeights)
+	return skipped
+}
+
+// WastedBytes returns the total size of the blocks which were received, but
+// then discarded, e.g. because they failed verification or the peer which
+// sent them was removed. It helps to quantify the cost of bad peers.
+func (pool *BlockPool) WastedBytes() int64 {
+	return atomic.LoadInt64(&pool.wastedBytes)
+}
+
+// TotalBytesDownloaded returns the total size of the blocks received from
+// peers while the pool was running, including the ones rejected (e.g.
+// duplicate, unexpected or oversized) or later discarded, so it's never less
+// than WastedBytes. Useful for telling the cost of a sync on a metered
+// connection.
+func (pool *BlockPool) TotalBytesDownloaded() int64 {
+	return atomic.LoadInt64(&pool.totalBytes)
+}
+
+// PeerStarvationTime returns the total time requesters have spent unable to
+// find an available peer, summed over the requesters, so it grows faster than
+// the wall clock when many of them wait at once. A quickly growing value means
+// the pool needs more peers, or more pending requests per peer.
+func (pool *BlockPool) PeerStarvationTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&pool.starvationTime))
+}
+
+// PinRequest makes the block at height be requested only from the given peer,
+// e.g. for deterministic replay or debugging. The usual eligibility checks are
+// skipped for it and it's never requested from another peer: if the peer is
+// removed, ErrPinnedPeerRemoved is reported and the request waits for the peer
+// to come back. It returns an error if the height was already requested from
+// another peer.
+func (pool *BlockPool) PinRequest(height int64, peerID p2p.ID) error {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	if r := pool.requesters[height]; r != nil {
+		if assignedID := r.getPeerID(); assignedID != "" && assignedID != peerID {
+			return fmt.Errorf("height %d is already requested from peer %v", height, assignedID)
+		}
+	}
+	pool.pinned[height] = peerID
+	return nil
+}
+
+// PausePeer stops assigning new requests to the peer, e.g. while it's being
+// upgraded, without forgetting its range. Requests already sent to the peer,
+// including the ones of heights pinned to it, are not affected. It returns an
+// error if there's no such peer.
+func (pool *BlockPool) PausePeer(peerID p2p.ID) error {
+	return pool.setPeerPaused(peerID, true)
+}
+
+// ResumePeer undoes PausePeer.
+func (pool *BlockPool) ResumePeer(peerID p2p.ID) error {
+	return pool.setPeerPaused(peerID, false)
+}
+
+func (pool *BlockPool) setPeerPaused(peerID p2p.ID, paused bool) error {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	peer := pool.peers[peerID]
+	if peer == nil {
+		return fmt.Errorf("unknown peer %v", peerID)
+	}
+	peer.paused = paused
+	return nil
+}
+
+// RedoRequest invalidates the block at pool.height,
+// Remove the peer and redo request from others.
+// Returns the ID of the removed peer.
+func (pool *BlockPool) RedoRequest(height int64) p2p.ID {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	return pool.redoRequest(height)
+}
+
+func (pool *BlockPool) redoRequest(height int64) p2p.ID {
+	request := pool.requesters[height]
+	// the block was rejected, so a different block from another peer is no
+	// sign of equivocation.
+	request.forgetFirstBlock()
+	peerID := request.getPeerID()
+	if peerID != p2p.ID("") {
+		// RemovePeer will redo all requesters associated with this peer.
+		pool.removePeer(peerID, "bad block")
+	}
+	return peerID
+}
+
+// PeerForHeight returns the peer the given height is currently requested
+// from. It returns false if there's no requester for the height or it's
+// waiting for a peer.
+func (pool *BlockPool) PeerForHeight(height int64) (p2p.ID, bool) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	r := pool.requesters[height]
+	if r == nil {
+		return "", false
+	}
+	peerID := r.getPeerID()
+	return peerID, peerID != ""
+}
+
+// AddBlock validates that the block comes from the peer it was expected from and calls the requester to store it.
+// Blocks arriving while the pool isn't running, e.g. during teardown, are
+// dropped.
+// See WithMaxDeliveryReorder to check that peers deliver blocks in order.
+func (pool *BlockPool) AddBlock(peerID p2p.ID, block *types.Block, blockSize int) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	if !pool.IsRunning() {
+		pool.Logger.Debug("dropping block as the pool isn't running", "peer", peerID, "height", block.Height)
+		return
+	}
+	atomic.AddInt64(&pool.totalBytes, int64(blockSize))
+
 	requester := pool.requesters[block.Height]
 	if requester == nil {
 		pool.Logger.Info(
@@ -261,49 +1678,463 @@ func (pool *BlockPool) AddBlock(peerID p2p.ID, block *types.Block, blockSize int
 		if diff < 0 {
 			diff *= -1
 		}
-		if diff > maxDiffBetweenCurrentAndReceivedBlockHeight {
-			pool.sendError(errors.New("peer sent us a block we didn't expect with a height too far ahead/behind"), peerID)
+		if pool.maxUnexpectedBlockDiff > 0 && diff > pool.maxUnexpectedBlockDiff {
+			pool.sendError(errors.New("peer sent us a block we didn't expect with a height too far ahead/behind"),
+				peerID, PeerErrorBlockMismatch)
 		}
 		return
 	}
 
-	if requester.setBlock(block, peerID) {
+	if pool.maxBlockBytes > 0 && blockSize > pool.maxBlockBytes {
+		pool.Logger.Info("peer sent us a block which is too big",
+			"peer", peerID, "blockHeight", block.Height, "size", blockSize, "maxSize", pool.maxBlockBytes)
+		atomic.AddInt64(&pool.wastedBytes, int64(blockSize))
+		pool.sendError(fmt.Errorf("block %d is too big: %d bytes, max %d",
+			block.Height, blockSize, pool.maxBlockBytes), peerID, PeerErrorOversized)
+		if requester.getBlock() == nil && requester.getPeerID() == peerID {
+			if peer := pool.peers[peerID]; peer != nil && peer.numPending > 0 {
+				peer.decrPending(0)
+			}
+			requester.redo(peerID)
+		}
+		return
+	}
+
+	if requester.wasRedoneFrom(peerID) {
+		// a late reply to a request which was redone, e.g. after it timed out.
+		pool.Logger.Debug("peer sent us a block after its request was redone", "peer", peerID, "blockHeight", block.Height)
+		return
+	}
+
+	if requester.getBlock() != nil {
+		if requester.takeRepeatReply(peerID) {
+			// the peer replied to both the request and its retry.
+			pool.Logger.Debug("peer sent us a block again after a retry", "peer", peerID, "blockHeight", block.Height)
+			return
+		}
+		pool.Logger.Info("peer sent us a duplicate block", "peer", peerID, "blockHeight", block.Height)
+		pool.sendError(errors.New("duplicate block"), peerID, PeerErrorDuplicate)
+		pool.countDuplicate(peerID)
+		return
+	}
+
+	if requester.getPeerID() != peerID {
+		// e.g. the peer answered the request for another height with this block.
+		pool.Logger.Info("peer sent us a block we didn't request from it", "peer", peerID, "blockHeight", block.Height)
+		pool.sendError(fmt.Errorf("block %d wasn't requested from the peer", block.Height),
+			peerID, PeerErrorBlockMismatch)
+		return
+	}
+
+	if peer := pool.peers[peerID]; peer != nil && pool.maxDeliveryReorder > 0 &&
+		block.Height < peer.maxDeliveredHeight-pool.maxDeliveryReorder {
+		pool.Logger.Info("peer sent us a block far below the ones it sent before",
+			"peer", peerID, "blockHeight", block.Height, "maxDeliveredHeight", peer.maxDeliveredHeight)
+		pool.sendError(fmt.Errorf("block %d is out of order, block %d was delivered before",
+			block.Height, peer.maxDeliveredHeight), peerID, PeerErrorOutOfOrder)
+		if requester.getPeerID() == peerID {
+			if peer.numPending > 0 {
+				peer.decrPending(0)
+			}
+			requester.redo(peerID)
+		}
+		return
+	}
+
+	if requester.setBlock(block, blockSize, peerID) {
 		atomic.AddInt32(&pool.numPending, -1)
+		pool.traceHeight(HeightBlockReceived, block.Height, peerID)
+		pool.releaseStandbyPeer(requester)
+		pool.sampleBlockSize(blockSize)
 		peer := pool.peers[peerID]
 		if peer != nil {
 			peer.decrPending(blockSize)
+			peer.numDelivered++
+			if block.Height > peer.maxDeliveredHeight {
+				peer.maxDeliveredHeight = block.Height
+			}
+			if peer.height > pool.trustedPeerHeight {
+				pool.trustedPeerHeight = peer.height
+			}
+			peer.totalLatency += time.Since(requester.getRequestedAt())
+			pool.checkStalling(peer)
+		}
+		if err := requester.checkConflict(block, peerID); err != nil {
+			// either peer may be the one lying, so neither is reported.
+			pool.Logger.Error("peers sent us conflicting blocks", "height", block.Height, "err", err)
+			pool.sendError(err, "", PeerErrorBlockMismatch)
 		}
 	} else {
 		pool.Logger.Info("invalid peer", "peer", peerID, "blockHeight", block.Height)
-		pool.sendError(errors.New("invalid peer"), peerID)
+		pool.sendError(errors.New("invalid peer"), peerID, PeerErrorBlockMismatch)
+	}
+}
+
+// Removes the peer if it keeps delivering blocks we already have.
+func (pool *BlockPool) countDuplicate(peerID p2p.ID) {
+	peer := pool.peers[peerID]
+	if peer == nil {
+		return
+	}
+	peer.numDuplicateBlocks++
+	if peer.numDuplicateBlocks > maxDuplicateBlocks {
+		pool.removePeer(peerID, "duplicate blocks")
 	}
 }
 
-// MaxPeerHeight returns the highest reported height.
+// Flags the peer if it keeps delivering blocks while withholding the block at
+// pool.height it was asked for.
+func (pool *BlockPool) checkStalling(peer *bpPeer) {
+	if pool.maxStalledBlocks <= 0 {
+		return
+	}
+
+	r := pool.requesters[pool.height]
+	if r == nil || r.getPeerID() != peer.id || r.getBlock() != nil {
+		peer.numStalledBlocks = 0
+		return
+	}
+
+	peer.numStalledBlocks++
+	if peer.numStalledBlocks >= pool.maxStalledBlocks && !peer.didTimeout {
+		err := errors.New("peer keeps sending blocks, but not the one we're waiting for")
+		pool.sendError(err, peer.id, PeerErrorNoResponse)
+		pool.logPeerEvent(peerEventTimedOut, peer.id,
+			"reason", err,
+			"height", pool.height,
+			"stalledBlocks", peer.numStalledBlocks)
+		peer.didTimeout = true
+	}
+}
+
+// Peer lifecycle events, see logPeerEvent.
+const (
+	peerEventAdded     = "added"
+	peerEventRemoved   = "removed"
+	peerEventTimedOut  = "timed out"
+	peerEventProbation = "on probation"
+	peerEventRecovered = "recovered"
+)
+
+// Logs a peer lifecycle event at the configured level. All events share the
+// same message and the "event" and "peer" fields, so they're easy to grep.
+func (pool *BlockPool) logPeerEvent(event string, peerID p2p.ID, keyvals ...interface{}) {
+	keyvals = append([]interface{}{"event", event, "peer", peerID}, keyvals...)
+	switch pool.peerEventLogLevel {
+	case "none":
+	case "debug":
+		pool.Logger.Debug("Peer event", keyvals...)
+	case "error":
+		pool.Logger.Error("Peer event", keyvals...)
+	default:
+		pool.Logger.Info("Peer event", keyvals...)
+	}
+}
+
+func (pool *BlockPool) hasPeer(peerID p2p.ID) bool {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	_, ok := pool.peers[peerID]
+	return ok
+}
+
+// MaxPeerHeight returns the highest reported height or, if
+// WithTrustedMaxPeerHeight is enabled, the highest height reported by a peer
+// which has delivered a block. It never decreases while the peer which
+// reported it is in the pool, even if the peer later reports a lower height,
+// so that a noisy peer can't make the target go back and forth.
 func (pool *BlockPool) MaxPeerHeight() int64 {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
+	return pool.targetHeight()
+}
+
+// ReportedMaxHeight returns the highest reported height, whether the peer
+// which reported it has delivered anything or not.
+func (pool *BlockPool) ReportedMaxHeight() int64 {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	return pool.maxPeerHeight
+}
+
+// Returns the height the pool syncs up to. Assumes the lock is held.
+func (pool *BlockPool) targetHeight() int64 {
+	if pool.trustedMaxPeerHeight {
+		return pool.trustedPeerHeight
+	}
 	return pool.maxPeerHeight
 }
 
+// PeersAhead returns the number of peers with a height above the pool's.
+func (pool *BlockPool) PeersAhead() int {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	n := 0
+	for _, peer := range pool.peers {
+		if peer.height > pool.height {
+			n++
+		}
+	}
+	return n
+}
+
+// HighestPeer returns the ID and height of the peer with the biggest height.
+// Ties are broken by the lowest ID. It returns an empty ID if there are no
+// peers.
+func (pool *BlockPool) HighestPeer() (p2p.ID, int64) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	var highest *bpPeer
+	for _, peer := range pool.peers {
+		if highest == nil || peer.height > highest.height ||
+			(peer.height == highest.height && peer.id < highest.id) {
+			highest = peer
+		}
+	}
+	if highest == nil {
+		return "", 0
+	}
+	return highest.id, highest.height
+}
+
 // SetPeerRange sets the peer's alleged blockchain base and height.
+// If the pool is full (see WithMaxPeers), a new peer either evicts a peer
+// chosen according to the pool's EvictionPolicy (by default, the one with the
+// lowest height) or, if there's none to evict, is ignored. A height lower than
+// the one the peer reported before is handled according to the pool's
+// HeightDecreasePolicy. Invalid ranges (negative or with base above height) are
+// ignored.
 func (pool *BlockPool) SetPeerRange(peerID p2p.ID, base int64, height int64) {
+	evictedID := pool.setPeerRange(peerID, base, height)
+	if evictedID != "" && pool.onPeerEvicted != nil {
+		pool.onPeerEvicted(evictedID)
+	}
+}
+
+// Returns the ID of the peer evicted to make room for peerID, if any.
+func (pool *BlockPool) setPeerRange(peerID p2p.ID, base int64, height int64) (evictedID p2p.ID) {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
+	if base < 0 || height < 0 || base > height {
+		pool.Logger.Info("Peer reported an invalid range, ignoring", "peer", peerID, "base", base, "height", height)
+		return ""
+	}
+	if pool.maxPeerRangeSpan > 0 && height-base > pool.maxPeerRangeSpan {
+		pool.Logger.Info("Peer reported a range too wide, ignoring",
+			"peer", peerID, "base", base, "height", height, "maxSpan", pool.maxPeerRangeSpan)
+		return ""
+	}
+	if pool.maxPeerHeightLead > 0 {
+		if ref, ok := pool.maxOtherPeerHeight(peerID); ok && height-ref > pool.maxPeerHeightLead {
+			pool.Logger.Info("Peer reported a height too far ahead, ignoring",
+				"peer", peerID, "height", height, "otherPeersHeight", ref, "maxLead", pool.maxPeerHeightLead)
+			return ""
+		}
+	}
+
 	peer := pool.peers[peerID]
 	if peer != nil {
+		if height < peer.height {
+			err := ErrPeerHeightDecreased{PeerID: peerID, PrevHeight: peer.height, Height: height}
+			pool.Logger.Info("Peer reported a lower height than before", "peer", peerID, "err", err)
+			switch pool.heightDecreasePolicy {
+			case HeightDecreaseReject:
+				return ""
+			case HeightDecreaseDisconnect:
+				pool.removePeer(peerID, "height decreased")
+				pool.sendError(err, peerID, PeerErrorBadStatus)
+				return ""
+			}
+		}
 		peer.base = base
 		peer.height = height
+		if height > peer.maxHeight {
+			peer.maxHeight = height
+		}
 	} else {
+		admission := PeerAccepted
+		if pool.onPeerAdd != nil {
+			admission = pool.onPeerAdd(peerID, base, height)
+		}
+		if admission == PeerRefused {
+			pool.Logger.Debug("Peer refused by OnPeerAdd, ignoring", "peer", peerID, "height", height)
+			return ""
+		}
+		if pool.maxPeers > 0 && len(pool.peers) >= pool.maxPeers {
+			evicted := pool.peerToEvict(height)
+			if evicted == nil {
+				pool.Logger.Debug("Pool is full, ignoring peer", "peer", peerID, "height", height)
+				return ""
+			}
+			evictedID = evicted.id
+			pool.removePeer(evictedID, "evicted")
+		}
+
 		peer = newBPPeer(pool, peerID, base, height)
 		peer.setLogger(pool.Logger.With("peer", peerID))
+		peer.untrusted = admission == PeerUntrusted
 		pool.peers[peerID] = peer
+		pool.logPeerEvent(peerEventAdded, peerID, "base", base, "height", height)
 	}
 
 	if height > pool.maxPeerHeight {
 		pool.maxPeerHeight = height
 	}
+	if peer.numDelivered > 0 && height > pool.trustedPeerHeight {
+		pool.trustedPeerHeight = height
+	}
+	return evictedID
+}
+
+// Returns the highest height reported by the peers other than peerID, or the
+// pool's height if it's higher. The second value is false if there are no
+// other peers.
+func (pool *BlockPool) maxOtherPeerHeight(peerID p2p.ID) (int64, bool) {
+	ref, ok := pool.height, false
+	for _, peer := range pool.peers {
+		if peer.id == peerID {
+			continue
+		}
+		ok = true
+		if peer.height > ref {
+			ref = peer.height
+		}
+	}
+	return ref, ok
+}
+
+// PendingPerPeer returns the number of pending requests of every peer. Useful
+// for telling whether the load is spread evenly across peers.
+func (pool *BlockPool) PendingPerPeer() map[p2p.ID]int32 {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	pending := make(map[p2p.ID]int32, len(pool.peers))
+	for _, peer := range pool.peers {
+		pending[peer.id] = peer.numPending
+	}
+	return pending
+}
+
+// PeerIdleDurations returns how long every peer has gone without delivering a
+// block, or since it was added if it hasn't delivered any. Peers idle for
+// close to peerTimeout while having pending requests are about to time out.
+func (pool *BlockPool) PeerIdleDurations() map[p2p.ID]time.Duration {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	now := time.Now()
+	idle := make(map[p2p.ID]time.Duration, len(pool.peers))
+	for _, peer := range pool.peers {
+		idle[peer.id] = now.Sub(peer.lastDeliveryAt)
+	}
+	return idle
+}
+
+// Reputation sums up how well a peer has served the pool so far.
+type Reputation struct {
+	// blocks delivered and accepted
+	NumDelivered int
+	// blocks rejected, e.g. because they were unexpected, duplicate, oversized
+	// or failed verification
+	NumRejected int
+	// requests the peer didn't serve in time
+	NumTimeouts int
+	// average time between requesting a block and receiving it or 0 if no
+	// block was delivered
+	AvgLatency time.Duration
+}
+
+// PeerReputation returns the reputation of every peer. It helps to decide
+// which peers are worth keeping, e.g. when the pool is full (see
+// WithMaxPeers).
+func (pool *BlockPool) PeerReputation() map[p2p.ID]Reputation {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	reputations := make(map[p2p.ID]Reputation, len(pool.peers))
+	for _, peer := range pool.peers {
+		reputations[peer.id] = peer.reputation()
+	}
+	return reputations
+}
+
+// PeerSnapshot is the part of a peer's state which may be persisted across
+// restarts, see BlockPool.ExportPeers.
+type PeerSnapshot struct {
+	ID     p2p.ID
+	Base   int64
+	Height int64
+}
+
+// ExportPeers returns the reported ranges of all peers, sorted by ID.
+func (pool *BlockPool) ExportPeers() []PeerSnapshot {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	snapshots := make([]PeerSnapshot, 0, len(pool.peers))
+	for _, peer := range pool.peers {
+		snapshots = append(snapshots, PeerSnapshot{ID: peer.id, Base: peer.base, Height: peer.height})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots
+}
+
+// ImportPeers adds the peers from snapshots (see ExportPeers) as if they had
+// reported their ranges via SetPeerRange. Peers already known to the pool are
+// skipped since their ranges are more recent. Imported peers start with no
+// requests pending.
+//
+// NOTE: the pool can't tell whether the peers are still connected. The ones
+// which are not are dropped once they time out.
+func (pool *BlockPool) ImportPeers(snapshots []PeerSnapshot) {
+	for _, snapshot := range snapshots {
+		if pool.hasPeer(snapshot.ID) {
+			continue
+		}
+		pool.SetPeerRange(snapshot.ID, snapshot.Base, snapshot.Height)
+	}
+}
+
+// Returns the peer to evict, according to the pool's EvictionPolicy, to make
+// room for a new peer at height, or nil if there's none.
+func (pool *BlockPool) peerToEvict(height int64) *bpPeer {
+	switch pool.evictionPolicy {
+	case EvictWorstReputation:
+		var worst *bpPeer
+		for _, peer := range pool.peers {
+			if worst == nil || peer.reputationScore() < worst.reputationScore() ||
+				(peer.reputationScore() == worst.reputationScore() && peer.height < worst.height) {
+				worst = peer
+			}
+		}
+		if worst == nil || worst.reputationScore() > 0 ||
+			(worst.reputationScore() == 0 && worst.height >= height) {
+			return nil
+		}
+		return worst
+	default:
+		lowest := pool.lowestPeer()
+		if lowest == nil || lowest.height >= height {
+			return nil
+		}
+		return lowest
+	}
+}
+
+// Returns the peer with the lowest height or nil if there are no peers.
+func (pool *BlockPool) lowestPeer() *bpPeer {
+	var lowest *bpPeer
+	for _, peer := range pool.peers {
+		if lowest == nil || peer.height < lowest.height {
+			lowest = peer
+		}
+	}
+	return lowest
 }
 
 // RemovePeer removes the peer with peerID from the pool. If there's no peer
@@ -312,73 +2143,320 @@ func (pool *BlockPool) RemovePeer(peerID p2p.ID) {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
-	pool.removePeer(peerID)
+	pool.removePeer(peerID, "requested")
 }
 
-func (pool *BlockPool) removePeer(peerID p2p.ID) {
+func (pool *BlockPool) removePeer(peerID p2p.ID, reason string) {
 	for _, requester := range pool.requesters {
+		requester.clearStandbyPeer(peerID)
 		if requester.getPeerID() == peerID {
 			requester.redo(peerID)
 		}
 	}
 
-	peer, ok := pool.peers[peerID]
-	if ok {
-		if peer.timeout != nil {
-			peer.timeout.Stop()
-		}
-
-		delete(pool.peers, peerID)
-
-		// Find a new peer with the biggest height and update maxPeerHeight if the
-		// peer's height was the biggest.
-		if peer.height == pool.maxPeerHeight {
-			pool.updateMaxPeerHeight()
-		}
+	peer, ok := pool.peers[peerID]
+	if ok {
+		if peer.timeout != nil {
+			peer.timeout.Stop()
+		}
+
+		delete(pool.peers, peerID)
+		pool.logPeerEvent(peerEventRemoved, peerID, "reason", reason)
+
+		pool.errorLimitsMtx.Lock()
+		delete(pool.errorLimits, peerID)
+		pool.errorLimitsMtx.Unlock()
+
+		// combined, so that a peer many heights are pinned to doesn't flood
+		// the logs and errorsCh.
+		var errs []error
+		for height, pinnedID := range pool.pinned {
+			if pinnedID == peerID {
+				errs = append(errs, ErrPinnedPeerRemoved{Height: height, PeerID: peerID})
+			}
+		}
+		if len(errs) > 0 {
+			sort.Slice(errs, func(i, j int) bool {
+				return errs[i].(ErrPinnedPeerRemoved).Height < errs[j].(ErrPinnedPeerRemoved).Height
+			})
+			var err error = MultiError{Errors: errs}
+			if len(errs) == 1 {
+				err = errs[0]
+			}
+			pool.Logger.Error("Pinned peer removed", "err", err)
+			pool.sendError(err, peerID, PeerErrorNoResponse)
+		}
+
+		// checked before maxPeerHeight is reset below.
+		if len(pool.peers) == 0 && pool.onNoPeers != nil && pool.height < pool.targetHeight()-1 {
+			pool.Logger.Info("Last peer removed before catching up", "height", pool.height)
+			pool.onNoPeers()
+		}
+
+		// Find a new peer with the biggest height and update maxPeerHeight if the
+		// peer's height was the biggest.
+		if peer.maxHeight == pool.maxPeerHeight || peer.maxHeight == pool.trustedPeerHeight {
+			pool.updateMaxPeerHeight()
+		}
+	}
+}
+
+// If no peers are left, maxPeerHeight is set to 0.
+func (pool *BlockPool) updateMaxPeerHeight() {
+	var max, trusted int64
+	for _, peer := range pool.peers {
+		if peer.maxHeight > max {
+			max = peer.maxHeight
+		}
+		if peer.numDelivered > 0 && peer.maxHeight > trusted {
+			trusted = peer.maxHeight
+		}
+	}
+	pool.maxPeerHeight = max
+	pool.trustedPeerHeight = trusted
+}
+
+// Pick an available peer with the given height available.
+// If no peers are available, returns nil.
+//
+// The choice is delegated to the pool's PeerSelector, which is called on a
+// snapshot of the eligible peers without holding the lock. Peers in failed
+// (see bpRequester.failedPeers) are only picked if no other peer is eligible.
+func (pool *BlockPool) pickIncrAvailablePeer(height int64, failed map[p2p.ID]struct{}) *bpPeer {
+	if peer, ok := pool.pickIncrPinnedPeer(height); ok {
+		return peer
+	}
+
+	candidates := pool.peerCandidates(height, failed)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	peerID, ok := pool.peerSelector.Select(candidates, height)
+	if !ok {
+		return nil
+	}
+
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	// the peer could have changed while we were not holding the lock.
+	peer := pool.peers[peerID]
+	if peer == nil || peer.ineligibleReason(height) != "" {
+		return nil
+	}
+	peer.incrPending()
+	return peer
+}
+
+// Picks the peer to request the requester's block from: its standby peer, if
+// it has one which is still eligible, or else any available peer. See
+// WithStandbyPeers.
+func (pool *BlockPool) pickIncrRequesterPeer(bpr *bpRequester) *bpPeer {
+	if peer := pool.takeStandbyPeer(bpr); peer != nil {
+		return peer
+	}
+	return pool.pickIncrAvailablePeer(bpr.height, bpr.getFailedPeers())
+}
+
+// Clears the requester's standby peer and returns it with its pending count
+// increased, unless it's gone or no longer eligible.
+func (pool *BlockPool) takeStandbyPeer(bpr *bpRequester) *bpPeer {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	bpr.mtx.Lock()
+	peerID := bpr.standbyPeerID
+	bpr.standbyPeerID = ""
+	_, failed := bpr.failedPeers[peerID]
+	bpr.mtx.Unlock()
+
+	peer := pool.peers[peerID]
+	if peer == nil {
+		return nil
+	}
+	peer.numStandby--
+	if failed || peer.ineligibleReason(bpr.height) != "" {
+		return nil
+	}
+	peer.incrPending()
+	return peer
+}
+
+// Picks a standby peer other than primaryID for the requester, if enabled and
+// it doesn't have one already.
+func (pool *BlockPool) pickStandbyPeer(bpr *bpRequester, primaryID p2p.ID) {
+	if !pool.standbyPeers {
+		return
+	}
+	pool.mtx.Lock()
+	_, pinned := pool.pinned[bpr.height]
+	pool.mtx.Unlock()
+	bpr.mtx.Lock()
+	hasStandby := bpr.standbyPeerID != ""
+	bpr.mtx.Unlock()
+	if pinned || hasStandby {
+		return
+	}
+
+	candidates := pool.peerCandidates(bpr.height, bpr.getFailedPeers())
+	for i, candidate := range candidates {
+		if candidate.ID == primaryID {
+			candidates = append(candidates[:i], candidates[i+1:]...)
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	peerID, ok := pool.peerSelector.Select(candidates, bpr.height)
+	if !ok {
+		return
+	}
+
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	peer := pool.peers[peerID]
+	if peer == nil || peer.ineligibleReason(bpr.height) != "" {
+		return
+	}
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+	if bpr.standbyPeerID != "" || bpr.block != nil {
+		return
+	}
+	peer.numStandby++
+	bpr.standbyPeerID = peerID
+}
+
+// Frees the slot the requester's standby peer, if any, holds. Assumes the lock
+// is held.
+func (pool *BlockPool) releaseStandbyPeer(bpr *bpRequester) {
+	bpr.mtx.Lock()
+	peerID := bpr.standbyPeerID
+	bpr.standbyPeerID = ""
+	bpr.mtx.Unlock()
+
+	if peer := pool.peers[peerID]; peer != nil {
+		peer.numStandby--
+	}
+}
+
+// Returns the peer the height is pinned to, if any, or nil if it's gone.
+// The second value is false if the height isn't pinned.
+func (pool *BlockPool) pickIncrPinnedPeer(height int64) (*bpPeer, bool) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	peerID, ok := pool.pinned[height]
+	if !ok {
+		return nil, false
+	}
+	peer := pool.peers[peerID]
+	if peer == nil || peer.paused || peer.untrusted {
+		return nil, true
+	}
+	peer.incrPending()
+	return peer, true
+}
+
+// Returns the peers eligible to serve the given height, removing the ones
+// which timed out. Peers in failed are left out, unless they're the only
+// eligible ones. For the heights the pool waits on, candidates are sorted
+// best first (see PeerInfo.isBetterThan); otherwise they're in random order.
+func (pool *BlockPool) peerCandidates(height int64, failed map[p2p.ID]struct{}) []PeerInfo {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	candidates := make([]PeerInfo, 0, len(pool.peers))
+	var failedCandidates []PeerInfo
+	for _, peer := range pool.peers {
+		switch peer.ineligibleReason(height) {
+		case "":
+		case ineligibleTimedOut:
+			if pool.autoRemoveSlowPeers {
+				pool.removePeer(peer.id, "timed out")
+			}
+			continue
+		default:
+			continue
+		}
+		if _, ok := failed[peer.id]; ok {
+			failedCandidates = append(failedCandidates, peer.info())
+			continue
+		}
+		candidates = append(candidates, peer.info())
+	}
+	// better retry a peer which failed than stall the height forever.
+	if len(candidates) == 0 {
+		candidates = failedCandidates
+	}
+
+	if pool.isPriorityHeight(height) {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].isBetterThan(candidates[j])
+		})
 	}
+	return candidates
 }
 
-// If no peers are left, maxPeerHeight is set to 0.
-func (pool *BlockPool) updateMaxPeerHeight() {
-	var max int64
-	for _, peer := range pool.peers {
-		if peer.height > max {
-			max = peer.height
-		}
+// Returns true if the block at height should be requested with priority.
+// Assumes the lock is held.
+func (pool *BlockPool) isPriorityHeight(height int64) bool {
+	return pool.headPriority && height <= pool.height+1
+}
+
+// Returns how long a requester should wait for the block before retrying.
+func (pool *BlockPool) requestRetryTimeout(height int64) time.Duration {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	if pool.isPriorityHeight(height) {
+		return priorityRequestRetrySeconds * time.Second
 	}
-	pool.maxPeerHeight = max
+	return requestRetrySeconds * time.Second
 }
 
-// Pick an available peer with the given height available.
-// If no peers are available, returns nil.
-func (pool *BlockPool) pickIncrAvailablePeer(height int64) *bpPeer {
+// WhyNotEligible returns, for every peer which can't be picked to serve the
+// given height, the reason it's excluded. Eligible peers are omitted. Useful
+// for diagnosing a sync stuck at some height.
+func (pool *BlockPool) WhyNotEligible(height int64) map[p2p.ID]string {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
+	reasons := make(map[p2p.ID]string)
 	for _, peer := range pool.peers {
-		if peer.didTimeout {
-			pool.removePeer(peer.id)
-			continue
-		}
-		if peer.numPending >= maxPendingRequestsPerPeer {
-			continue
-		}
-		if height < peer.base || height > peer.height {
-			continue
+		if reason := peer.ineligibleReason(height); reason != "" {
+			reasons[peer.id] = reason
 		}
-		peer.incrPending()
-		return peer
 	}
-	return nil
+	return reasons
+}
+
+// Returns true if blocks aren't requested for the height, which is at or
+// above the pool's height, because it's too far ahead (see WithPrefetchAhead)
+// or at or beyond the end height (see WithEndHeight).
+func (pool *BlockPool) beyondRequestWindow(height int64) bool {
+	return height-pool.height > pool.prefetchAhead || (pool.endHeight > 0 && height >= pool.endHeight)
 }
 
-func (pool *BlockPool) makeNextRequester() {
+// Returns false if no requester was made.
+func (pool *BlockPool) makeNextRequester() bool {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
-	nextHeight := pool.height + pool.requestersLen()
-	if nextHeight > pool.maxPeerHeight {
-		return
+	nextHeight, ok := pool.nextRequesterHeight()
+	if !ok {
+		return false
+	}
+	if nextHeight > pool.maxPeerHeight || pool.beyondRequestWindow(nextHeight) {
+		return false
+	}
+	// re-check under the lock as blocks may have arrived in the meantime.
+	numStored := len(pool.requesters) - int(atomic.LoadInt32(&pool.numPending))
+	if pool.maxStoredBlocks > 0 && numStored >= pool.maxStoredBlocks {
+		return false
 	}
 
 	request := newBPRequester(pool, nextHeight)
@@ -388,7 +2466,34 @@ func (pool *BlockPool) makeNextRequester() {
 
 	err := request.Start()
 	if err != nil {
-		request.Logger.Error("Error starting request", "err", err)
+		// nothing would ever serve the requester, so don't leave it behind.
+		pool.Logger.Error("Error starting requester", "height", nextHeight, "err", err)
+		delete(pool.requesters, nextHeight)
+		atomic.AddInt32(&pool.numPending, -1)
+		return false
+	}
+	pool.traceHeight(HeightRequested, nextHeight, "")
+	return true
+}
+
+// Returns the lowest height at or above pool.height without a requester.
+// Usually that's the one right above the highest requester, unless there's a
+// gap left by CancelRequest. Returns false if every height up to
+// math.MaxInt64 has a requester.
+func (pool *BlockPool) nextRequesterHeight() (int64, bool) {
+	if pool.requestersLen() <= math.MaxInt64-pool.height {
+		nextHeight := pool.height + pool.requestersLen()
+		if _, ok := pool.requesters[nextHeight]; !ok {
+			return nextHeight, true
+		}
+	}
+	for h := pool.height; ; h++ {
+		if _, ok := pool.requesters[h]; !ok {
+			return h, true
+		}
+		if h == math.MaxInt64 {
+			return 0, false
+		}
 	}
 }
 
@@ -396,38 +2501,206 @@ func (pool *BlockPool) requestersLen() int64 {
 	return int64(len(pool.requesters))
 }
 
+// Returns the heights of the requesters, lowest first. There may be gaps, e.g.
+// after CancelRequest or InjectBlock.
+func (pool *BlockPool) sortedRequesterHeights() []int64 {
+	heights := make([]int64, 0, len(pool.requesters))
+	for height := range pool.requesters {
+		heights = append(heights, height)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights
+}
+
+// NotifyChannelsClosed tells the pool that requestsCh and errorsCh are about
+// to be closed, so nothing is sent on them anymore. Sends blocked on the
+// channels are aborted, and it returns once they are, so the channels may be
+// closed right after. It must be called before the channels are closed,
+// preferably after the pool has been stopped.
+func (pool *BlockPool) NotifyChannelsClosed() {
+	if atomic.CompareAndSwapUint32(&pool.channelsClosed, 0, 1) {
+		close(pool.channelsClosing)
+	}
+	// wait for the sends in progress
+	pool.channelsMtx.Lock()
+	pool.channelsMtx.Unlock() //nolint:staticcheck // empty critical section on purpose
+}
+
+// Returns true if it's safe to send on requestsCh and errorsCh. The caller
+// must hold channelsMtx for reading until the send is done.
+func (pool *BlockPool) canSend() bool {
+	return pool.IsRunning() && atomic.LoadUint32(&pool.channelsClosed) == 0
+}
+
 func (pool *BlockPool) sendRequest(height int64, peerID p2p.ID) {
-	if !pool.IsRunning() {
+	if pool.blockProvider != nil {
+		pool.provideBlock(height, peerID)
+		return
+	}
+	pool.channelsMtx.RLock()
+	defer pool.channelsMtx.RUnlock()
+	if !pool.canSend() {
+		return
+	}
+	start := pool.beginSend()
+	select {
+	case pool.requestsCh <- BlockRequest{height, peerID}:
+	case <-pool.channelsClosing:
+	case <-pool.Quit():
+	}
+	pool.endSend(start)
+}
+
+// Adds the block from the pool's BlockProvider as if peerID had sent it.
+func (pool *BlockPool) provideBlock(height int64, peerID p2p.ID) {
+	block, err := pool.blockProvider(height)
+	if err != nil {
+		pool.Logger.Error("Failed to provide block", "height", height, "err", err)
 		return
 	}
-	pool.requestsCh <- BlockRequest{height, peerID}
+	pool.AddBlock(peerID, block, block.Size())
 }
 
-func (pool *BlockPool) sendError(err error, peerID p2p.ID) {
-	if !pool.IsRunning() {
+func (pool *BlockPool) sendError(err error, peerID p2p.ID, reason PeerErrorReason) {
+	pool.recordPeerError(peerID, reason)
+	pool.channelsMtx.RLock()
+	defer pool.channelsMtx.RUnlock()
+	if !pool.canSend() {
+		return
+	}
+	err, ok := pool.limitError(err, peerID)
+	if !ok {
 		return
 	}
-	pool.errorsCh <- peerError{err, peerID}
+	start := pool.beginSend()
+	select {
+	case pool.errorsCh <- peerError{err, peerID, reason}:
+	case <-pool.channelsClosing:
+	case <-pool.Quit():
+	}
+	pool.endSend(start)
 }
 
-// for debugging purposes
-//
-//nolint:unused
-func (pool *BlockPool) debug() string {
+// Updates the reputation of the peer, if it's still known, with an error
+// reported for it. Assumes the lock is held.
+func (pool *BlockPool) recordPeerError(peerID p2p.ID, reason PeerErrorReason) {
+	peer := pool.peers[peerID]
+	if peer == nil {
+		return
+	}
+	switch reason {
+	case PeerErrorTooSlow, PeerErrorNoResponse:
+		peer.numTimeouts++
+	case PeerErrorBadBlock, PeerErrorBlockMismatch, PeerErrorOversized, PeerErrorDuplicate,
+		PeerErrorOutOfOrder:
+		peer.numRejected++
+	}
+}
+
+// Counts a request the peer didn't serve in time.
+func (pool *BlockPool) recordRequestTimeout(peerID p2p.ID) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	if peer := pool.peers[peerID]; peer != nil {
+		peer.numTimeouts++
+	}
+}
+
+// errorLimit tracks the errors sent for a peer within the current window.
+type errorLimit struct {
+	windowStart   time.Time
+	numSent       int
+	numSuppressed int
+}
+
+// Returns false if the error should be dropped because too many errors were
+// sent for the peer lately (see WithErrorRateLimit). Otherwise, returns the
+// error to send, coalesced with the ones dropped before. Errors for peers
+// which aren't in the pool, e.g. because they were just removed, aren't
+// limited, so that no state is kept for them. Assumes the lock is held.
+func (pool *BlockPool) limitError(err error, peerID p2p.ID) (error, bool) {
+	if pool.errorBurst <= 0 || pool.peers[peerID] == nil {
+		return err, true
+	}
+
+	pool.errorLimitsMtx.Lock()
+	defer pool.errorLimitsMtx.Unlock()
+
+	limit := pool.errorLimits[peerID]
+	if limit == nil {
+		limit = &errorLimit{windowStart: time.Now()}
+		pool.errorLimits[peerID] = limit
+	} else if time.Since(limit.windowStart) >= pool.errorWindow {
+		limit.windowStart = time.Now()
+		limit.numSent = 0
+	}
+
+	if limit.numSent >= pool.errorBurst {
+		limit.numSuppressed++
+		return nil, false
+	}
+	limit.numSent++
+	if limit.numSuppressed > 0 {
+		err = ErrCoalesced{Err: err, NumSuppressed: limit.numSuppressed}
+		limit.numSuppressed = 0
+	}
+	return err, true
+}
+
+// DebugString returns a human readable summary of the requesters, starting at
+// the pool's height: whether each one has a block (B?) and which peer it's
+// assigned to (P). At most debugStringMaxHeights heights are included (see
+// WithDebugStringMaxHeights), so it's safe to log or attach to bug reports.
+func (pool *BlockPool) DebugString() string {
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
 
-	str := ""
-	nextHeight := pool.height + pool.requestersLen()
-	for h := pool.height; h < nextHeight; h++ {
-		if pool.requesters[h] == nil {
-			str += fmt.Sprintf("H(%v):X ", h)
+	heights := pool.sortedRequesterHeights()
+	if len(heights) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	last := heights[len(heights)-1]
+	for h := pool.height; ; h++ {
+		if h-pool.height >= int64(pool.debugStringMaxHeights) {
+			fmt.Fprintf(&sb, "... (%d more)", last-h+1)
+			break
+		}
+		if r := pool.requesters[h]; r == nil {
+			fmt.Fprintf(&sb, "H(%v):X ", h)
 		} else {
-			str += fmt.Sprintf("H(%v):", h)
-			str += fmt.Sprintf("B?(%v) ", pool.requesters[h].block != nil)
+			fmt.Fprintf(&sb, "H(%v):B?(%v)P(%v) ", h, r.getBlock() != nil, r.getPeerID())
+		}
+		if h == last {
+			break
 		}
 	}
-	return str
+	return strings.TrimSpace(sb.String())
+}
+
+// ExportWindowProto returns the heights being requested, the peers they're
+// requested from and whether their blocks have arrived, lowest first, as a
+// protobuf message, so that a monitoring sidecar may collect it over the wire.
+// Unlike DebugString, it's not truncated.
+func (pool *BlockPool) ExportWindowProto() *bcproto.PoolWindow {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	window := &bcproto.PoolWindow{
+		Height:   pool.height,
+		Requests: make([]*bcproto.PoolRequest, 0, len(pool.requesters)),
+	}
+	for _, h := range pool.sortedRequesterHeights() {
+		r := pool.requesters[h]
+		window.Requests = append(window.Requests, &bcproto.PoolRequest{
+			Height:   h,
+			PeerId:   string(r.getPeerID()),
+			HasBlock: r.getBlock() != nil,
+		})
+	}
+	return window
 }
 
 //-------------------------------------
@@ -439,9 +2712,40 @@ type bpPeer struct {
 	base        int64
 	pool        *BlockPool
 	id          p2p.ID
-	recvMonitor *flow.Monitor
-
-	timeout *time.Timer
+	recvMonitor rateMonitor
+	addedAt     time.Time
+	// when the peer last delivered a block, or addedAt if it hasn't yet
+	lastDeliveryAt time.Time
+
+	// see BlockPool.PausePeer
+	paused bool
+	// see PeerUntrusted
+	untrusted bool
+
+	// blocks delivered while withholding the one at pool.height
+	numStalledBlocks int
+	// blocks delivered for heights which already had one
+	numDuplicateBlocks int
+
+	// requests the peer is the standby for, see WithStandbyPeers
+	numStandby int32
+
+	// see Reputation
+	numDelivered int
+	numRejected  int
+	numTimeouts  int
+	totalLatency time.Duration
+
+	// the highest height reported, see BlockPool.MaxPeerHeight
+	maxHeight int64
+	// when the peer's probation ends, or zero if it's not on probation, see
+	// WithSlowPeerProbation
+	probationUntil time.Time
+	// the highest height delivered, see WithMaxDeliveryReorder
+	maxDeliveredHeight int64
+
+	timeout    *time.Timer
+	curTimeout time.Duration // the timeout was last reset to
 
 	logger log.Logger
 }
@@ -452,30 +2756,105 @@ func newBPPeer(pool *BlockPool, peerID p2p.ID, base int64, height int64) *bpPeer
 		id:         peerID,
 		base:       base,
 		height:     height,
+		maxHeight:  height,
 		numPending: 0,
+		addedAt:    time.Now(),
 		logger:     log.NewNopLogger(),
 	}
+	peer.lastDeliveryAt = peer.addedAt
 	return peer
 }
 
+// Reasons why a peer may not be picked to serve a height.
+const (
+	ineligibleTimedOut    = "timed out"
+	ineligiblePaused      = "paused"
+	ineligibleUntrusted   = "untrusted"
+	ineligiblePendingFull = "pending full"
+	ineligibleBelowBase   = "below base"
+	ineligibleAboveHeight = "above height"
+)
+
+// Returns why the peer can't serve the given height or an empty string if it
+// can.
+func (peer *bpPeer) ineligibleReason(height int64) string {
+	switch {
+	case peer.didTimeout:
+		return ineligibleTimedOut
+	case peer.paused:
+		return ineligiblePaused
+	case peer.untrusted:
+		return ineligibleUntrusted
+	case peer.numPending+peer.numStandby >= maxPendingRequestsPerPeer:
+		return ineligiblePendingFull
+	case height < peer.base:
+		return ineligibleBelowBase
+	case height > peer.height:
+		return ineligibleAboveHeight
+	}
+	return ""
+}
+
+// Returns a snapshot of the peer's state.
+func (peer *bpPeer) info() PeerInfo {
+	info := PeerInfo{
+		ID:         peer.id,
+		Base:       peer.base,
+		Height:     peer.height,
+		NumPending: peer.numPending,
+	}
+	if peer.recvMonitor != nil {
+		info.CurRate = peer.recvMonitor.Status().CurRate
+	}
+	return info
+}
+
+func (peer *bpPeer) reputation() Reputation {
+	r := Reputation{
+		NumDelivered: peer.numDelivered,
+		NumRejected:  peer.numRejected,
+		NumTimeouts:  peer.numTimeouts,
+	}
+	if peer.numDelivered > 0 {
+		r.AvgLatency = peer.totalLatency / time.Duration(peer.numDelivered)
+	}
+	return r
+}
+
+// Returns the balance of the blocks the peer delivered and the ones it failed
+// to, see EvictWorstReputation.
+func (peer *bpPeer) reputationScore() int {
+	return peer.numDelivered - peer.numRejected - peer.numTimeouts
+}
+
 func (peer *bpPeer) setLogger(l log.Logger) {
 	peer.logger = l
 }
 
 func (peer *bpPeer) resetMonitor() {
-	peer.recvMonitor = flow.New(time.Second, time.Second*40)
-	initialValue := float64(minRecvRate) * math.E
+	if peer.pool.disableRateLimiting {
+		return
+	}
+	peer.recvMonitor = peer.pool.newRecvMonitor()
+	initialValue := float64(minRecvRate) * peer.pool.recvRateSeed
 	peer.recvMonitor.SetREMA(initialValue)
 }
 
 func (peer *bpPeer) resetTimeout() {
+	peer.curTimeout = peer.timeoutDuration()
 	if peer.timeout == nil {
-		peer.timeout = time.AfterFunc(peerTimeout, peer.onTimeout)
+		peer.timeout = time.AfterFunc(peer.curTimeout, peer.onTimeout)
 	} else {
-		peer.timeout.Reset(peerTimeout)
+		peer.timeout.Reset(peer.curTimeout)
 	}
 }
 
+// Returns peerTimeout plus a random jitter of up to peerTimeoutJitter of it.
+func (peer *bpPeer) timeoutDuration() time.Duration {
+	jitter := float64(peerTimeout) * peerTimeoutJitter * peer.pool.jitterSource()
+	return peerTimeout + time.Duration(jitter)
+}
+
 func (peer *bpPeer) incrPending() {
 	if peer.numPending == 0 {
 		peer.resetMonitor()
@@ -486,10 +2865,15 @@ func (peer *bpPeer) incrPending() {
 
 func (peer *bpPeer) decrPending(recvSize int) {
 	peer.numPending--
+	if recvSize > 0 { // not just a released request
+		peer.lastDeliveryAt = time.Now()
+	}
 	if peer.numPending == 0 {
 		peer.timeout.Stop()
 	} else {
-		peer.recvMonitor.Update(recvSize)
+		if peer.recvMonitor != nil {
+			peer.recvMonitor.Update(recvSize)
+		}
 		peer.resetTimeout()
 	}
 }
@@ -499,11 +2883,23 @@ func (peer *bpPeer) onTimeout() {
 	defer peer.pool.mtx.Unlock()
 
 	err := errors.New("peer did not send us anything")
-	peer.pool.sendError(err, peer.id)
-	peer.logger.Error("SendTimeout", "reason", err, "timeout", peerTimeout)
+	peer.pool.sendError(err, peer.id, PeerErrorNoResponse)
+	peer.pool.logPeerEvent(peerEventTimedOut, peer.id, "reason", err, "timeout", peer.curTimeout)
 	peer.didTimeout = true
 }
 
+// rateMonitor measures the rate at which data is received from a peer.
+// Implemented by *flow.Monitor; tests may use a fake to control the rate.
+type rateMonitor interface {
+	Update(n int) int
+	SetREMA(rEMA float64)
+	Status() flow.Status
+}
+
+func newFlowMonitor() rateMonitor {
+	return flow.New(time.Second, time.Second*40)
+}
+
 //-------------------------------------
 
 type bpRequester struct {
@@ -513,9 +2909,43 @@ type bpRequester struct {
 	gotBlockCh chan struct{}
 	redoCh     chan p2p.ID // redo may send multitime, add peerId to identify repeat
 
-	mtx    tmsync.Mutex
-	peerID p2p.ID
-	block  *types.Block
+	mtx         tmsync.Mutex
+	peerID      p2p.ID
+	block       *types.Block
+	blockSize   int
+	commit      *types.Commit // for block, see BlockPool.AddCommit
+	requestedAt time.Time     // when the block was last requested from peerID
+	numRedos    int           // times the requester was reset
+
+	// used instead of requestRoutine's state when the pool has requester
+	// workers, see WithRequesterWorkers
+	lastPeerID   p2p.ID
+	retryTimer   *time.Timer
+	starvedSince time.Time // when the requester was parked without a peer
+
+	// see WithStandbyPeers
+	standbyPeerID p2p.ID
+	// see WithSamePeerRetries
+	numSamePeerRetries int
+	// repeated requests sent to peerID whose replies are yet to arrive or be
+	// counted as duplicates; unlike numSamePeerRetries, kept after the block
+	// arrives
+	numRepeatRequests int
+
+	// hash of the first block set for this height and the peer which sent it.
+	// Unlike block, these survive redos so we can detect equivocation, unless
+	// the block is rejected with RedoRequest.
+	firstHash   tmbytes.HexBytes
+	firstPeerID p2p.ID
+
+	// peers the height was requested from before being redone, whose late
+	// replies are ignored; at most maxFailedPeersPerHeight
+	prevPeerIDs map[p2p.ID]struct{}
+
+	// peers which were removed while serving this height. They're skipped
+	// when picking a peer so a flapping peer isn't asked again for the same
+	// height. Cleared once the block is set.
+	failedPeers map[p2p.ID]struct{}
 }
 
 func newBPRequester(pool *BlockPool, height int64) *bpRequester {
@@ -533,18 +2963,42 @@ func newBPRequester(pool *BlockPool, height int64) *bpRequester {
 }
 
 func (bpr *bpRequester) OnStart() error {
-	go bpr.requestRoutine()
+	if bpr.getBlock() != nil {
+		// injected, possibly before the pool started; see BlockPool.InjectBlock.
+		return nil
+	}
+	if !bpr.pool.IsRunning() {
+		return errors.New("pool isn't running")
+	}
+	if bpr.pool.requesterWorkers > 0 {
+		bpr.pool.requesterQueue.push(bpr)
+		return nil
+	}
+	bpr.pool.spawnRequesterRoutine(fmt.Sprintf("requestRoutine(%d)", bpr.height), bpr.requestRoutine)
 	return nil
 }
 
-// Returns true if the peer matches and block doesn't already exist.
-func (bpr *bpRequester) setBlock(block *types.Block, peerID p2p.ID) bool {
+func (bpr *bpRequester) OnStop() {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+
+	if bpr.retryTimer != nil {
+		bpr.retryTimer.Stop()
+	}
+}
+
+// Returns true if the peer matches and block doesn't already exist. The block is
+// for bpr.height, as it's looked up by its height.
+func (bpr *bpRequester) setBlock(block *types.Block, blockSize int, peerID p2p.ID) bool {
 	bpr.mtx.Lock()
 	if bpr.block != nil || bpr.peerID != peerID {
 		bpr.mtx.Unlock()
 		return false
 	}
 	bpr.block = block
+	bpr.blockSize = blockSize
+	bpr.failedPeers = nil
+	bpr.numSamePeerRetries = 0
 	bpr.mtx.Unlock()
 
 	select {
@@ -554,35 +3008,228 @@ func (bpr *bpRequester) setBlock(block *types.Block, peerID p2p.ID) bool {
 	return true
 }
 
+// Records the hash of the first block set for this height. Returns
+// ErrConflictingBlocks if a later block hashes to something different, unless
+// the first block was rejected, see forgetFirstBlock.
+func (bpr *bpRequester) checkConflict(block *types.Block, peerID p2p.ID) error {
+	hash := block.Hash()
+	if len(hash) == 0 {
+		return nil
+	}
+
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+
+	if len(bpr.firstHash) == 0 {
+		bpr.firstHash = hash
+		bpr.firstPeerID = peerID
+		return nil
+	}
+	if bytes.Equal(bpr.firstHash, hash) {
+		return nil
+	}
+	return ErrConflictingBlocks{
+		Height:     bpr.height,
+		FirstPeer:  bpr.firstPeerID,
+		FirstHash:  bpr.firstHash,
+		SecondPeer: peerID,
+		SecondHash: hash,
+	}
+}
+
+// Returns true if the height was requested from peerID before, but isn't
+// anymore.
+func (bpr *bpRequester) wasRedoneFrom(peerID p2p.ID) bool {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+	_, ok := bpr.prevPeerIDs[peerID]
+	return ok && bpr.peerID != peerID
+}
+
+// Forgets the first block set for this height, as it was rejected.
+func (bpr *bpRequester) forgetFirstBlock() {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+	bpr.firstHash = nil
+	bpr.firstPeerID = ""
+}
+
 func (bpr *bpRequester) getBlock() *types.Block {
 	bpr.mtx.Lock()
 	defer bpr.mtx.Unlock()
 	return bpr.block
 }
 
+// Returns true, counting the retry, if the request may be sent to the same
+// peer again, see WithSamePeerRetries.
+func (bpr *bpRequester) takeSamePeerRetry() bool {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+	if bpr.numSamePeerRetries >= bpr.pool.samePeerRetries {
+		return false
+	}
+	bpr.numSamePeerRetries++
+	bpr.numRepeatRequests++
+	return true
+}
+
+// Returns true if the block peerID sent again answers a repeated request to
+// the same peer rather than being a duplicate, see WithSamePeerRetries.
+func (bpr *bpRequester) takeRepeatReply(peerID p2p.ID) bool {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+	if bpr.peerID != peerID || bpr.numRepeatRequests == 0 {
+		return false
+	}
+	bpr.numRepeatRequests--
+	return true
+}
+
+// Forgets the standby peer if it's peerID, e.g. because the peer was removed.
+func (bpr *bpRequester) clearStandbyPeer(peerID p2p.ID) {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+	if bpr.standbyPeerID == peerID {
+		bpr.standbyPeerID = ""
+	}
+}
+
+func (bpr *bpRequester) getBlockSize() int {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+	return bpr.blockSize
+}
+
+func (bpr *bpRequester) getDelivery() (p2p.ID, int) {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+	return bpr.peerID, bpr.numRedos
+}
+
+func (bpr *bpRequester) getBlockAndCommit() (*types.Block, *types.Commit) {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+	return bpr.block, bpr.commit
+}
+
+// Returns true if the block is set and the commit is for it.
+func (bpr *bpRequester) setCommit(commit *types.Commit) bool {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+
+	if bpr.block == nil || !bpr.block.HashesTo(commit.BlockID.Hash) {
+		return false
+	}
+	bpr.commit = commit
+	return true
+}
+
 func (bpr *bpRequester) getPeerID() p2p.ID {
 	bpr.mtx.Lock()
 	defer bpr.mtx.Unlock()
 	return bpr.peerID
 }
 
+func (bpr *bpRequester) getRequestedAt() time.Time {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+	return bpr.requestedAt
+}
+
+// Returns a copy of the peers which failed this height.
+func (bpr *bpRequester) getFailedPeers() map[p2p.ID]struct{} {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+
+	failed := make(map[p2p.ID]struct{}, len(bpr.failedPeers))
+	for peerID := range bpr.failedPeers {
+		failed[peerID] = struct{}{}
+	}
+	return failed
+}
+
+// Remembers the peer failed this height, unless enough peers already have.
+func (bpr *bpRequester) addFailedPeer(peerID p2p.ID) {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+
+	if len(bpr.failedPeers) >= maxFailedPeersPerHeight {
+		return
+	}
+	if bpr.failedPeers == nil {
+		bpr.failedPeers = make(map[p2p.ID]struct{})
+	}
+	bpr.failedPeers[peerID] = struct{}{}
+}
+
 // This is called from the requestRoutine, upon redo().
 func (bpr *bpRequester) reset() {
 	bpr.mtx.Lock()
 	defer bpr.mtx.Unlock()
 
+	bpr.clear()
+}
+
+// Resets the requester if it's assigned to peerID and, if keepBlock is true,
+// has no block yet. Returns true if it was reset. Used by requester workers,
+// for which the check and the reset must be atomic.
+func (bpr *bpRequester) resetIfAssigned(peerID p2p.ID, keepBlock bool) bool {
+	bpr.mtx.Lock()
+	defer bpr.mtx.Unlock()
+
+	if peerID == "" || bpr.peerID != peerID || (keepBlock && bpr.block != nil) {
+		return false
+	}
+	if bpr.retryTimer != nil {
+		bpr.retryTimer.Stop()
+	}
+	bpr.clear()
+	return true
+}
+
+// Assumes the lock is held.
+func (bpr *bpRequester) clear() {
 	if bpr.block != nil {
 		atomic.AddInt32(&bpr.pool.numPending, 1)
+		atomic.AddInt64(&bpr.pool.wastedBytes, int64(bpr.blockSize))
 	}
 
+	if bpr.peerID != "" {
+		bpr.pool.traceHeight(HeightRedone, bpr.height, bpr.peerID)
+		if len(bpr.prevPeerIDs) < maxFailedPeersPerHeight {
+			if bpr.prevPeerIDs == nil {
+				bpr.prevPeerIDs = make(map[p2p.ID]struct{})
+			}
+			bpr.prevPeerIDs[bpr.peerID] = struct{}{}
+		}
+	}
 	bpr.peerID = ""
 	bpr.block = nil
+	bpr.blockSize = 0
+	bpr.commit = nil
+	bpr.numRedos++
+	bpr.numSamePeerRetries = 0
+	bpr.numRepeatRequests = 0
+
+	// drop the signal of a block we've just discarded, if not consumed yet.
+	select {
+	case <-bpr.gotBlockCh:
+	default:
+	}
 }
 
 // Tells bpRequester to pick another peer and try again.
 // NOTE: Nonblocking, and does nothing if another redo
-// was already requested.
+// was already requested: redoCh is buffered to 1, so a redo
+// is pending until the requestRoutine receives it.
 func (bpr *bpRequester) redo(peerID p2p.ID) {
+	bpr.addFailedPeer(peerID)
+	if bpr.pool.requesterWorkers > 0 {
+		if bpr.resetIfAssigned(peerID, false) {
+			bpr.pool.requesterQueue.push(bpr)
+		}
+		return
+	}
 	select {
 	case bpr.redoCh <- peerID:
 	default:
@@ -591,31 +3238,60 @@ func (bpr *bpRequester) redo(peerID p2p.ID) {
 
 // Responsible for making more requests as necessary
 // Returns only when a block is found (e.g. AddBlock() is called)
+//
+// Signals on gotBlockCh and redoCh may be dropped or arrive late, so the
+// routine never relies on them alone: the peer is re-checked after it's been
+// assigned, and the block is re-checked before retrying on timeout.
 func (bpr *bpRequester) requestRoutine() {
+	var prevPeerID p2p.ID
 OUTER_LOOP:
 	for {
 		// Pick a peer to send request to.
 		var peer *bpPeer
+		var starvedSince time.Time
 	PICK_PEER_LOOP:
 		for {
 			if !bpr.IsRunning() || !bpr.pool.IsRunning() {
 				return
 			}
-			peer = bpr.pool.pickIncrAvailablePeer(bpr.height)
+			peer = bpr.pool.pickIncrRequesterPeer(bpr)
 			if peer == nil {
+				if starvedSince.IsZero() {
+					starvedSince = time.Now()
+				}
 				bpr.Logger.Debug("No peers currently available; will retry shortly", "height", bpr.height)
 				time.Sleep(requestIntervalMS * time.Millisecond)
 				continue PICK_PEER_LOOP
 			}
 			break PICK_PEER_LOOP
 		}
+		if !starvedSince.IsZero() {
+			atomic.AddInt64(&bpr.pool.starvationTime, int64(time.Since(starvedSince)))
+		}
 		bpr.mtx.Lock()
 		bpr.peerID = peer.id
 		bpr.mtx.Unlock()
+		bpr.pool.traceHeight(HeightPeerAssigned, bpr.height, peer.id)
+
+		if prevPeerID != "" && prevPeerID != peer.id && bpr.pool.onRequesterReassigned != nil {
+			bpr.pool.onRequesterReassigned(bpr.height, prevPeerID, peer.id)
+		}
+		prevPeerID = peer.id
 
-		to := time.NewTimer(requestRetrySeconds * time.Second)
+		// The peer could have been removed before we've set peerID, in which
+		// case no redo was sent our way.
+		if !bpr.pool.hasPeer(peer.id) {
+			bpr.reset()
+			continue OUTER_LOOP
+		}
+
+		to := time.NewTimer(bpr.pool.requestRetryTimeout(bpr.height))
 		// Send request and wait.
+		bpr.mtx.Lock()
+		bpr.requestedAt = time.Now()
+		bpr.mtx.Unlock()
 		bpr.pool.sendRequest(bpr.height, peer.id)
+		bpr.pool.pickStandbyPeer(bpr, peer.id)
 	WAIT_LOOP:
 		for {
 			select {
@@ -627,7 +3303,39 @@ OUTER_LOOP:
 			case <-bpr.Quit():
 				return
 			case <-to.C:
-				bpr.Logger.Debug("Retrying block request after timeout", "height", bpr.height, "peer", bpr.peerID)
+				if bpr.getBlock() != nil {
+					// We got the block before the timeout, keep it.
+					continue WAIT_LOOP
+				}
+				if bpr.takeSamePeerRetry() {
+					bpr.Logger.Debug("Retrying block request with the same peer", "height", bpr.height, "peer", peer.id)
+					bpr.pool.recordRequestTimeout(peer.id)
+					select {
+					case <-time.After(bpr.pool.samePeerRetryDelay):
+					case <-bpr.pool.Quit():
+						if err := bpr.Stop(); err != nil {
+							bpr.Logger.Error("Error stopped requester", "err", err)
+						}
+						return
+					case <-bpr.Quit():
+						return
+					}
+					switch {
+					case bpr.getBlock() != nil || bpr.getPeerID() != peer.id:
+						// got the block or redone in the meantime.
+						continue WAIT_LOOP
+					case bpr.pool.hasPeer(peer.id):
+						to.Reset(bpr.pool.requestRetryTimeout(bpr.height))
+						bpr.mtx.Lock()
+						bpr.requestedAt = time.Now()
+						bpr.mtx.Unlock()
+						bpr.pool.sendRequest(bpr.height, peer.id)
+						continue WAIT_LOOP
+					}
+				} else {
+					bpr.Logger.Debug("Retrying block request after timeout", "height", bpr.height, "peer", bpr.peerID)
+					bpr.pool.recordRequestTimeout(peer.id)
+				}
 				// Simulate a redo
 				bpr.reset()
 				continue OUTER_LOOP
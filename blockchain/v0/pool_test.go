@@ -1,16 +1,24 @@
 package v0
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	flow "github.com/tendermint/tendermint/libs/flowrate"
 	"github.com/tendermint/tendermint/libs/log"
 	tmrand "github.com/tendermint/tendermint/libs/rand"
 	"github.com/tendermint/tendermint/p2p"
+	bcproto "github.com/tendermint/tendermint/proto/tendermint/blockchain"
 	"github.com/tendermint/tendermint/types"
 )
 
@@ -77,15 +85,36 @@ func makePeers(numPeers int, minHeight, maxHeight int64) testPeers {
 	return peers
 }
 
+// Starts a pool at height 1, which is stopped when the test ends.
+func newTestPool(
+	t *testing.T,
+	requestsCh chan<- BlockRequest,
+	errorsCh chan<- peerError,
+	options ...BlockPoolOption,
+) *BlockPool {
+	t.Helper()
+	pool, err := NewBlockPool(1, requestsCh, errorsCh, options...)
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	require.NoError(t, pool.Start())
+	t.Cleanup(func() {
+		if err := pool.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	return pool
+}
+
 func TestBlockPoolBasic(t *testing.T) {
 	start := int64(42)
 	peers := makePeers(10, start+1, 1000)
 	errorsCh := make(chan peerError, 1000)
 	requestsCh := make(chan BlockRequest, 1000)
-	pool := NewBlockPool(start, requestsCh, errorsCh)
+	pool, err := NewBlockPool(start, requestsCh, errorsCh)
+	require.NoError(t, err)
 	pool.SetLogger(log.TestingLogger())
 
-	err := pool.Start()
+	err = pool.Start()
 	if err != nil {
 		t.Error(err)
 	}
@@ -112,9 +141,11 @@ func TestBlockPoolBasic(t *testing.T) {
 			if !pool.IsRunning() {
 				return
 			}
-			first, second := pool.PeekTwoBlocks()
+			first, second, _ := pool.PeekTwoBlocks()
 			if first != nil && second != nil {
-				pool.PopRequest()
+				if err := pool.PopRequest(); err != nil {
+					t.Error(err)
+				}
 			} else {
 				time.Sleep(1 * time.Second)
 			}
@@ -142,9 +173,10 @@ func TestBlockPoolTimeout(t *testing.T) {
 	peers := makePeers(10, start+1, 1000)
 	errorsCh := make(chan peerError, 1000)
 	requestsCh := make(chan BlockRequest, 1000)
-	pool := NewBlockPool(start, requestsCh, errorsCh)
+	pool, err := NewBlockPool(start, requestsCh, errorsCh)
+	require.NoError(t, err)
 	pool.SetLogger(log.TestingLogger())
-	err := pool.Start()
+	err = pool.Start()
 	if err != nil {
 		t.Error(err)
 	}
@@ -171,9 +203,11 @@ func TestBlockPoolTimeout(t *testing.T) {
 			if !pool.IsRunning() {
 				return
 			}
-			first, second := pool.PeekTwoBlocks()
+			first, second, _ := pool.PeekTwoBlocks()
 			if first != nil && second != nil {
-				pool.PopRequest()
+				if err := pool.PopRequest(); err != nil {
+					t.Error(err)
+				}
 			} else {
 				time.Sleep(1 * time.Second)
 			}
@@ -188,6 +222,7 @@ func TestBlockPoolTimeout(t *testing.T) {
 		case err := <-errorsCh:
 			t.Log(err)
 			// consider error to be always timeout here
+			assert.Equal(t, PeerErrorNoResponse, err.reason)
 			if _, ok := timedOut[err.peerID]; !ok {
 				counter++
 				if counter == len(peers) {
@@ -210,15 +245,7 @@ func TestBlockPoolRemovePeer(t *testing.T) {
 	requestsCh := make(chan BlockRequest)
 	errorsCh := make(chan peerError)
 
-	pool := NewBlockPool(1, requestsCh, errorsCh)
-	pool.SetLogger(log.TestingLogger())
-	err := pool.Start()
-	require.NoError(t, err)
-	t.Cleanup(func() {
-		if err := pool.Stop(); err != nil {
-			t.Error(err)
-		}
-	})
+	pool := newTestPool(t, requestsCh, errorsCh)
 
 	// add peers
 	for peerID, peer := range peers {
@@ -240,3 +267,2359 @@ func TestBlockPoolRemovePeer(t *testing.T) {
 
 	assert.EqualValues(t, 0, pool.MaxPeerHeight())
 }
+
+func TestBlockPoolConflictingBlocks(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	makeBlock := func(chainID string) *types.Block {
+		return &types.Block{
+			Header: types.Header{
+				ChainID:        chainID,
+				Height:         1,
+				ValidatorsHash: []byte("validators"),
+			},
+			LastCommit: &types.Commit{},
+		}
+	}
+
+	pool.SetPeerRange("first", 1, 1)
+	request := <-requestsCh
+	require.EqualValues(t, "first", request.PeerID)
+	pool.AddBlock("first", makeBlock("chain-a"), 123)
+
+	// the peer disconnects, so its block is dropped without being rejected,
+	// and the height is handed over to another peer.
+	pool.RemovePeer("first")
+	pool.SetPeerRange("second", 1, 1)
+	request = <-requestsCh
+	require.EqualValues(t, "second", request.PeerID)
+	pool.AddBlock("second", makeBlock("chain-b"), 123)
+
+	select {
+	case err := <-errorsCh:
+		// either peer may be lying, so neither is reported.
+		assert.EqualValues(t, "", err.peerID)
+		assert.Equal(t, PeerErrorBlockMismatch, err.reason)
+		var conflict ErrConflictingBlocks
+		require.ErrorAs(t, err.err, &conflict)
+		assert.EqualValues(t, 1, conflict.Height)
+		assert.EqualValues(t, "first", conflict.FirstPeer)
+		assert.EqualValues(t, "second", conflict.SecondPeer)
+		assert.NotEqual(t, conflict.FirstHash, conflict.SecondHash)
+	case <-time.After(time.Second):
+		t.Fatal("expected conflicting blocks error")
+	}
+}
+
+func TestBlockPoolRejectedBlockIsNoConflict(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	makeBlock := func(chainID string) *types.Block {
+		return &types.Block{
+			Header: types.Header{
+				ChainID:        chainID,
+				Height:         1,
+				ValidatorsHash: []byte("validators"),
+			},
+			LastCommit: &types.Commit{},
+		}
+	}
+
+	pool.SetPeerRange("bad", 1, 1)
+	request := <-requestsCh
+	require.EqualValues(t, "bad", request.PeerID)
+	pool.AddBlock("bad", makeBlock("chain-a"), 123)
+
+	// the block fails validation, as the reactor does.
+	pool.RedoRequest(1)
+	pool.SetPeerRange("honest", 1, 1)
+	request = <-requestsCh
+	require.EqualValues(t, "honest", request.PeerID)
+	pool.AddBlock("honest", makeBlock("chain-b"), 123)
+
+	first, _, _ := pool.PeekTwoBlocks()
+	require.NotNil(t, first)
+	assert.Equal(t, "chain-b", first.ChainID)
+	assert.Empty(t, errorsCh, "the honest peer must not be reported")
+}
+
+func TestBlockPoolAddCommit(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	block := &types.Block{
+		Header:     types.Header{ChainID: "chain", Height: 1, ValidatorsHash: []byte("validators")},
+		LastCommit: &types.Commit{},
+	}
+	commit := &types.Commit{Height: 1, BlockID: types.BlockID{Hash: block.Hash()}}
+
+	pool.SetPeerRange("peer", 1, 1)
+	request := <-requestsCh
+
+	// no block to pair it with yet.
+	pool.AddCommit("peer", 1, commit)
+	pool.AddBlock(request.PeerID, block, 123)
+	first, _, firstCommit := pool.PeekTwoBlocks()
+	assert.Equal(t, block, first)
+	assert.Nil(t, firstCommit)
+
+	// a commit for another block.
+	pool.AddCommit("liar", 1, &types.Commit{Height: 1, BlockID: types.BlockID{Hash: []byte("other")}})
+	select {
+	case err := <-errorsCh:
+		assert.EqualValues(t, "liar", err.peerID)
+		assert.Equal(t, PeerErrorBlockMismatch, err.reason)
+	case <-time.After(time.Second):
+		t.Fatal("expected the peer to be reported")
+	}
+	_, _, firstCommit = pool.PeekTwoBlocks()
+	assert.Nil(t, firstCommit)
+
+	pool.AddCommit("peer", 1, commit)
+	first, _, firstCommit = pool.PeekTwoBlocks()
+	assert.Equal(t, block, first)
+	assert.Equal(t, commit, firstCommit)
+
+	// the commit goes along with the block.
+	pool.RedoRequest(1)
+	require.Eventually(t, func() bool {
+		first, _, firstCommit := pool.PeekTwoBlocks()
+		return first == nil && firstCommit == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBlockPoolShutdownTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError, 10),
+		WithShutdownTimeout(100*time.Millisecond),
+		WithBlockProvider(func(height int64) (*types.Block, error) {
+			<-unblock
+			return nil, errors.New("unblocked")
+		}))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	err = pool.Start()
+	require.NoError(t, err)
+
+	// the provider blocks, so the requester for height 1 gets stuck
+	// requesting its block.
+	pool.SetPeerRange("peer", 1, 1)
+	require.Eventually(t, func() bool {
+		_, _, lenRequesters := pool.GetStatus()
+		return lenRequesters == 1
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, pool.Stop())
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, []string{"requestRoutine(1)"}, pool.aliveRoutines())
+
+	// unblock the requester so it can exit.
+	close(unblock)
+	pool.routinesWg.Wait()
+	assert.Empty(t, pool.aliveRoutines())
+}
+
+func TestBlockPoolAliveRoutinesSameName(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+
+	// e.g. a requester recreated for the same height before the old goroutine
+	// exited.
+	exitOld, exitNew := make(chan struct{}), make(chan struct{})
+	pool.spawn("requestRoutine(1)", func() { <-exitOld })
+	pool.spawn("requestRoutine(1)", func() { <-exitNew })
+	assert.Equal(t, []string{"requestRoutine(1)", "requestRoutine(1)"}, pool.aliveRoutines())
+
+	close(exitOld)
+	require.Eventually(t, func() bool {
+		return len(pool.aliveRoutines()) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"requestRoutine(1)"}, pool.aliveRoutines())
+
+	close(exitNew)
+	pool.routinesWg.Wait()
+	assert.Empty(t, pool.aliveRoutines())
+}
+
+func TestBlockPoolShutdownWaitsForRoutines(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool, err := NewBlockPool(1, requestsCh, errorsCh, WithShutdownTimeout(time.Second))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	err = pool.Start()
+	require.NoError(t, err)
+
+	pool.SetPeerRange("peer", 1, 5)
+	for i := 0; i < 5; i++ {
+		<-requestsCh
+	}
+
+	require.NoError(t, pool.Stop())
+	assert.Empty(t, pool.aliveRoutines())
+}
+
+func TestBlockPoolContextCancelled(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pool, err := NewBlockPool(1, requestsCh, make(chan peerError, 10), WithContext(ctx))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	err = pool.Start()
+	require.NoError(t, err)
+
+	pool.SetPeerRange("peer", 1, 5)
+	for i := 0; i < 5; i++ {
+		<-requestsCh
+	}
+	require.NotEmpty(t, pool.aliveRoutines())
+
+	cancel()
+	require.Eventually(t, func() bool {
+		return !pool.IsRunning() && len(pool.aliveRoutines()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBlockPoolAddBlockAfterStop(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool, err := NewBlockPool(1, requestsCh, errorsCh)
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	err = pool.Start()
+	require.NoError(t, err)
+
+	pool.SetPeerRange("peer", 1, 1)
+	request := <-requestsCh
+	require.NoError(t, pool.Stop())
+	pool.NotifyChannelsClosed()
+	close(errorsCh)
+
+	assert.NotPanics(t, func() {
+		pool.AddBlock(request.PeerID, &types.Block{Header: types.Header{Height: 1}}, 123)
+		pool.AddBlock(request.PeerID, &types.Block{Header: types.Header{Height: 1000}}, 123)
+	})
+	first, _, _ := pool.PeekTwoBlocks()
+	assert.Nil(t, first)
+	assert.Zero(t, pool.TotalBytesDownloaded())
+}
+
+func TestBlockPoolNumRequesterGoroutines(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	pool, err := NewBlockPool(1, requestsCh, make(chan peerError, 10), WithShutdownTimeout(time.Second))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	err = pool.Start()
+	require.NoError(t, err)
+	assert.Zero(t, pool.NumRequesterGoroutines())
+
+	pool.SetPeerRange("peer", 1, 5)
+	for i := 0; i < 5; i++ {
+		<-requestsCh
+	}
+	assert.Equal(t, 5, pool.NumRequesterGoroutines())
+
+	require.NoError(t, pool.Stop())
+	assert.Zero(t, pool.NumRequesterGoroutines())
+}
+
+func TestBlockPoolWhyNotEligible(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("eligible", 1, 10)
+	pool.SetPeerRange("timedout", 1, 10)
+	pool.SetPeerRange("busy", 1, 10)
+	pool.SetPeerRange("pruned", 6, 10)
+	pool.SetPeerRange("short", 1, 4)
+	pool.peers["timedout"].didTimeout = true
+	pool.peers["busy"].numPending = maxPendingRequestsPerPeer
+
+	assert.Equal(t, map[p2p.ID]string{
+		"timedout": "timed out",
+		"busy":     "pending full",
+		"pruned":   "below base",
+		"short":    "above height",
+	}, pool.WhyNotEligible(5))
+}
+
+func TestBlockPoolStallingPeer(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 100)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh, WithMaxStalledBlocks(5))
+
+	// The peer promptly serves every request except the one for the pool's
+	// height, keeping its rate up while the pool never advances.
+	pool.SetPeerRange("chaffer", 1, 100)
+	for {
+		select {
+		case err := <-errorsCh:
+			assert.EqualValues(t, "chaffer", err.peerID)
+			assert.Equal(t, PeerErrorNoResponse, err.reason)
+			return
+		case request := <-requestsCh:
+			if request.Height == 1 {
+				continue
+			}
+			block := &types.Block{Header: types.Header{Height: request.Height}}
+			pool.AddBlock(request.PeerID, block, 123)
+		case <-time.After(time.Second):
+			t.Fatal("expected the stalling peer to be reported")
+		}
+	}
+}
+
+func TestBlockPoolRateLimitingDisabled(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError), WithRateLimitingDisabled())
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("peer", 1, 10)
+	peer := pool.pickIncrAvailablePeer(1, nil)
+	require.NotNil(t, peer)
+	peer.incrPending()
+	assert.Nil(t, peer.recvMonitor)
+
+	peer.decrPending(123)
+	assert.NotPanics(t, pool.removeTimedoutPeers)
+	assert.Contains(t, pool.peers, peer.id)
+	peer.timeout.Stop()
+}
+
+func TestNewBlockPoolInvalidStart(t *testing.T) {
+	for _, start := range []int64{0, -1} {
+		_, err := NewBlockPool(start, make(chan BlockRequest), make(chan peerError))
+		assert.Error(t, err, "start %d", start)
+	}
+}
+
+func TestBlockPoolMaxPeers(t *testing.T) {
+	var evicted []p2p.ID
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError),
+		WithMaxPeers(2, func(peerID p2p.ID) { evicted = append(evicted, peerID) }))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("a", 1, 10)
+	pool.SetPeerRange("b", 1, 20)
+
+	// not taller than anyone, so it's refused
+	pool.SetPeerRange("c", 1, 5)
+	assert.NotContains(t, pool.peers, p2p.ID("c"))
+	assert.Empty(t, evicted)
+
+	// updating a known peer is always allowed
+	pool.SetPeerRange("a", 1, 15)
+	assert.EqualValues(t, 15, pool.peers["a"].height)
+
+	// taller than "a", which gets evicted
+	pool.SetPeerRange("d", 1, 30)
+	assert.Contains(t, pool.peers, p2p.ID("d"))
+	assert.NotContains(t, pool.peers, p2p.ID("a"))
+	assert.Equal(t, []p2p.ID{"a"}, evicted)
+	assert.EqualValues(t, 30, pool.MaxPeerHeight())
+}
+
+func TestBlockPoolEvictWorstReputation(t *testing.T) {
+	var evicted []p2p.ID
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError),
+		WithMaxPeers(2, func(peerID p2p.ID) { evicted = append(evicted, peerID) }),
+		WithEvictionPolicy(EvictWorstReputation))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("good", 1, 10)
+	pool.SetPeerRange("bad", 1, 20)
+	pool.peers["good"].numDelivered = 5
+	pool.peers["bad"].numDelivered = 5
+	pool.peers["bad"].numTimeouts = 6
+
+	// lower than both, but "bad" is evicted for its reputation.
+	pool.SetPeerRange("c", 1, 5)
+	assert.Contains(t, pool.peers, p2p.ID("c"))
+	assert.NotContains(t, pool.peers, p2p.ID("bad"))
+	assert.Equal(t, []p2p.ID{"bad"}, evicted)
+
+	// "c" has no history, so only a taller peer evicts it.
+	pool.SetPeerRange("d", 1, 5)
+	assert.NotContains(t, pool.peers, p2p.ID("d"))
+	pool.SetPeerRange("d", 1, 6)
+	assert.Contains(t, pool.peers, p2p.ID("d"))
+	assert.Equal(t, []p2p.ID{"bad", "c"}, evicted)
+
+	// both peers have delivered blocks, so neither is evicted however tall the
+	// new one is.
+	pool.peers["d"].numDelivered = 1
+	pool.SetPeerRange("e", 1, 100)
+	assert.NotContains(t, pool.peers, p2p.ID("e"))
+	assert.Equal(t, []p2p.ID{"bad", "c"}, evicted)
+}
+
+func TestBlockPoolSyncRate(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.lastWindowTime = time.Now().Add(-10 * time.Second)
+
+	pop := func(n int) {
+		for i := 0; i < n; i++ {
+			pool.requesters[pool.height] = newBPRequester(pool, pool.height)
+			require.NoError(t, pool.PopRequest())
+		}
+	}
+
+	pop(syncRateWindow - 1)
+	assert.Zero(t, pool.SyncRate(), "no rate until the first window completes")
+
+	pop(1)
+	assert.InDelta(t, 10, pool.SyncRate(), 0.1)
+}
+
+func TestBlockPoolThroughputMBps(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.lastWindowTime = time.Now().Add(-10 * time.Second)
+
+	assert.Zero(t, pool.ThroughputMBps())
+
+	// half of the blocks are 1MB and the other half 3MB, at 10 blocks/s.
+	for i := 0; i < syncRateWindow; i++ {
+		r := newBPRequester(pool, pool.height)
+		r.block = &types.Block{Header: types.Header{Height: pool.height}}
+		r.blockSize = 1000000
+		if i%2 == 1 {
+			r.blockSize = 3000000
+		}
+		pool.requesters[pool.height] = r
+		require.NoError(t, pool.PopRequest())
+	}
+	assert.InDelta(t, 20, pool.ThroughputMBps(), 0.5)
+}
+
+func TestBlockPoolSyncRateHistory(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError), WithSyncRateHistorySize(2))
+	require.NoError(t, err)
+
+	popWindow := func(d time.Duration) {
+		pool.lastWindowTime = time.Now().Add(-d)
+		for i := 0; i < syncRateWindow; i++ {
+			pool.requesters[pool.height] = newBPRequester(pool, pool.height)
+			require.NoError(t, pool.PopRequest())
+		}
+	}
+
+	assert.Empty(t, pool.SyncRateHistory())
+	popWindow(10 * time.Second)
+	popWindow(20 * time.Second)
+	popWindow(50 * time.Second)
+
+	history := pool.SyncRateHistory()
+	require.Len(t, history, 2)
+	assert.InDelta(t, 5, history[0], 0.1)
+	assert.InDelta(t, 2, history[1], 0.1)
+}
+
+func TestBlockPoolDeliveryAudit(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError), WithDeliveryAuditSize(2))
+	require.NoError(t, err)
+
+	for _, peerID := range []p2p.ID{"a", "b", "c"} {
+		r := newBPRequester(pool, pool.height)
+		// a bad block was discarded first.
+		r.peerID = "bad"
+		r.block = &types.Block{Header: types.Header{Height: pool.height}}
+		r.clear()
+		r.peerID = peerID
+		r.block = &types.Block{Header: types.Header{Height: pool.height}}
+		pool.requesters[pool.height] = r
+		require.NoError(t, pool.PopRequest())
+	}
+
+	assert.Equal(t, []DeliveryRecord{
+		{Height: 2, PeerID: "b", NumRedos: 1},
+		{Height: 3, PeerID: "c", NumRedos: 1},
+	}, pool.DeliveryAudit())
+}
+
+func TestBlockPoolEstimatedCompletionTime(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("peer", 1, 201)
+	_, ok := pool.EstimatedTimeRemaining()
+	assert.False(t, ok)
+	_, ok = pool.EstimatedCompletionTime()
+	assert.False(t, ok)
+
+	pool.lastSyncRate = 10
+	remaining, ok := pool.EstimatedTimeRemaining()
+	require.True(t, ok)
+	assert.Equal(t, 20*time.Second, remaining)
+
+	before := time.Now()
+	completion, ok := pool.EstimatedCompletionTime()
+	require.True(t, ok)
+	assert.WithinDuration(t, before.Add(20*time.Second), completion, time.Second)
+
+	pool.height = 300
+	remaining, ok = pool.EstimatedTimeRemaining()
+	require.True(t, ok)
+	assert.Zero(t, remaining)
+}
+
+func TestBlockPoolPeerEventLogging(t *testing.T) {
+	var buf bytes.Buffer
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError), WithPeerEventLogLevel("debug"))
+	require.NoError(t, err)
+	pool.SetLogger(log.NewFilter(log.NewTMLogger(log.NewSyncWriter(&buf)), log.AllowDebug()))
+
+	pool.SetPeerRange("peer", 3, 10)
+	assert.Contains(t, buf.String(), "Peer event")
+	assert.Contains(t, buf.String(), "event=added peer=peer base=3 height=10")
+
+	buf.Reset()
+	pool.RemovePeer("peer")
+	assert.Contains(t, buf.String(), "event=removed peer=peer reason=requested")
+
+	// nothing is logged at a filtered level
+	buf.Reset()
+	pool.SetLogger(log.NewFilter(log.NewTMLogger(log.NewSyncWriter(&buf)), log.AllowInfo()))
+	pool.SetPeerRange("peer", 3, 10)
+	assert.Empty(t, buf.String())
+}
+
+func TestBlockPoolMaxStoredBlocks(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 100)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh, WithMaxStoredBlocks(3))
+
+	// deliver every requested block, but don't pop any of them.
+	go func() {
+		for request := range requestsCh {
+			block := &types.Block{Header: types.Header{Height: request.Height}}
+			pool.AddBlock(request.PeerID, block, 123)
+		}
+	}()
+	pool.SetPeerRange("peer", 1, 3)
+	require.Eventually(t, func() bool {
+		_, numPending, lenRequesters := pool.GetStatus()
+		return numPending == 0 && lenRequesters == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// the peer has more blocks, but the consumer is behind.
+	pool.SetPeerRange("peer", 1, 100)
+	time.Sleep(100 * time.Millisecond)
+	_, _, lenRequesters := pool.GetStatus()
+	assert.Equal(t, 3, lenRequesters, "no new requesters while consumer is behind")
+
+	// popping a block lets the pool request more.
+	require.NoError(t, pool.PopRequest())
+	require.Eventually(t, func() bool {
+		_, _, lenRequesters := pool.GetStatus()
+		return lenRequesters > 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBlockPoolPrefetchAhead(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 100)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh, WithPrefetchAhead(5))
+
+	go func() {
+		for request := range requestsCh {
+			block := &types.Block{Header: types.Header{Height: request.Height}}
+			pool.AddBlock(request.PeerID, block, 123)
+		}
+	}()
+	pool.SetPeerRange("peer", 1, 100)
+	require.Eventually(t, func() bool {
+		_, numPending, lenRequesters := pool.GetStatus()
+		return numPending == 0 && lenRequesters == 6
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	_, _, lenRequesters := pool.GetStatus()
+	assert.Equal(t, 6, lenRequesters, "no requesters beyond height+5")
+
+	// popping a block moves the window.
+	require.NoError(t, pool.PopRequest())
+	require.Eventually(t, func() bool {
+		pool.mtx.Lock()
+		defer pool.mtx.Unlock()
+		_, ok := pool.requesters[7]
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	assert.NotContains(t, pool.requesters, int64(8))
+}
+
+// Measures how long it takes to pop blocks near the tip of the chain, where
+// peers announce one new block at a time, so every new requester is for one
+// of the two heights the pool waits on. One of the peers is slow.
+func BenchmarkBlockPoolHeadPriority(b *testing.B) {
+	delays := map[p2p.ID]time.Duration{
+		"fast": 0,
+		"slow": 5 * time.Millisecond,
+	}
+
+	for _, enabled := range []bool{true, false} {
+		enabled := enabled
+		b.Run(fmt.Sprintf("priority=%v", enabled), func(b *testing.B) {
+			requestsCh := make(chan BlockRequest, maxTotalRequesters)
+			errorsCh := make(chan peerError, 1000)
+			pool, err := NewBlockPool(1, requestsCh, errorsCh, WithHeadPriority(enabled))
+			require.NoError(b, err)
+			require.NoError(b, pool.Start())
+			defer func() { require.NoError(b, pool.Stop()) }()
+
+			// each peer serves its requests sequentially.
+			inputs := make(map[p2p.ID]chan BlockRequest)
+			for peerID, delay := range delays {
+				input := make(chan BlockRequest, maxTotalRequesters)
+				inputs[peerID] = input
+				go func(delay time.Duration) {
+					for {
+						select {
+						case request := <-input:
+							time.Sleep(delay)
+							block := &types.Block{Header: types.Header{Height: request.Height}}
+							pool.AddBlock(request.PeerID, block, 123)
+						case <-pool.Quit():
+							return
+						}
+					}
+				}(delay)
+				pool.SetPeerRange(peerID, 1, 2)
+			}
+			go func() {
+				for {
+					select {
+					case request := <-requestsCh:
+						inputs[request.PeerID] <- request
+					case <-pool.Quit():
+						return
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; {
+				if first, second, _ := pool.PeekTwoBlocks(); first == nil || second == nil {
+					time.Sleep(10 * time.Microsecond)
+					continue
+				}
+				require.NoError(b, pool.PopRequest())
+				height, _, _ := pool.GetStatus()
+				for peerID := range delays {
+					pool.SetPeerRange(peerID, 1, height+1)
+				}
+				i++
+			}
+		})
+	}
+}
+
+func TestBlockPoolCancelRequest(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	pool.SetPeerRange("peer", 1, 5)
+	for i := 0; i < 5; i++ {
+		<-requestsCh
+	}
+	pool.mtx.Lock()
+	requester := pool.requesters[4]
+	pool.mtx.Unlock()
+
+	assert.NotPanics(t, func() { pool.CancelRequest(42) })
+	pool.CancelRequest(3)
+
+	// the gap is filled with a new requester, leaving the others intact.
+	select {
+	case request := <-requestsCh:
+		assert.Equal(t, BlockRequest{3, "peer"}, request)
+	case <-time.After(time.Second):
+		t.Fatal("expected height 3 to be requested again")
+	}
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	assert.Same(t, requester, pool.requesters[4])
+	assert.Len(t, pool.requesters, 5)
+	assert.EqualValues(t, 5, atomic.LoadInt32(&pool.numPending))
+	assert.EqualValues(t, 5, pool.peers["peer"].numPending)
+}
+
+// Hammers the requesters with blocks and redos to make sure none of them gets
+// stuck without a block once things calm down.
+func TestBlockPoolRedoStress(t *testing.T) {
+	const maxHeight = 50
+	peers := []p2p.ID{"a", "b", "c", "d"}
+	requestsCh := make(chan BlockRequest, 1000)
+	errorsCh := make(chan peerError, 1000)
+
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	go func() {
+		for {
+			select {
+			case request := <-requestsCh:
+				block := &types.Block{Header: types.Header{Height: request.Height}}
+				go pool.AddBlock(request.PeerID, block, 123)
+			case <-errorsCh:
+			case <-pool.Quit():
+				return
+			}
+		}
+	}()
+	for _, peerID := range peers {
+		pool.SetPeerRange(peerID, 1, maxHeight)
+	}
+	require.Eventually(t, func() bool {
+		_, _, lenRequesters := pool.GetStatus()
+		return lenRequesters == maxHeight
+	}, time.Second, 10*time.Millisecond)
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		height := 1 + tmrand.Int63n(maxHeight)
+		if peerID := pool.RedoRequest(height); peerID != "" {
+			pool.SetPeerRange(peerID, 1, maxHeight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// well below the retry timeouts, so no requester may rely on them.
+	require.Eventually(t, func() bool {
+		_, numPending, _ := pool.GetStatus()
+		return numPending == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	for height := int64(1); height <= maxHeight; height++ {
+		assert.NotNil(t, pool.requesters[height].getBlock(), "height %d", height)
+	}
+}
+
+func TestBlockPoolDebugString(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError), WithDebugStringMaxHeights(2))
+	require.NoError(t, err)
+	assert.Empty(t, pool.DebugString())
+
+	for h := int64(1); h <= 3; h++ {
+		pool.requesters[h] = newBPRequester(pool, h)
+	}
+	pool.requesters[1].peerID = "peer"
+	pool.requesters[1].block = &types.Block{Header: types.Header{Height: 1}}
+
+	assert.Equal(t, "H(1):B?(true)P(peer) H(2):B?(false)P() ... (1 more)", pool.DebugString())
+
+	// gaps are shown, and the requesters above them aren't left out.
+	pool.debugStringMaxHeights = defaultDebugStringMaxHeights
+	delete(pool.requesters, 2)
+	pool.requesters[5] = newBPRequester(pool, 5)
+	assert.Equal(t, "H(1):B?(true)P(peer) H(2):X H(3):B?(false)P() H(4):X H(5):B?(false)P()", pool.DebugString())
+}
+
+func TestBlockPoolExportWindowProto(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10))
+
+	pool.SetPeerRange("peer", 1, 3)
+	for i := 0; i < 3; i++ {
+		<-requestsCh
+	}
+	pool.AddBlock("peer", &types.Block{Header: types.Header{Height: 2}}, 123)
+	// out of sequence, leaving a gap at height 4.
+	require.NoError(t, pool.InjectBlock(5, &types.Block{Header: types.Header{Height: 5}}))
+
+	bz, err := proto.Marshal(pool.ExportWindowProto())
+	require.NoError(t, err)
+	window := new(bcproto.PoolWindow)
+	require.NoError(t, proto.Unmarshal(bz, window))
+
+	assert.Equal(t, &bcproto.PoolWindow{
+		Height: 1,
+		Requests: []*bcproto.PoolRequest{
+			{Height: 1, PeerId: "peer", HasBlock: false},
+			{Height: 2, PeerId: "peer", HasBlock: true},
+			{Height: 3, PeerId: "peer", HasBlock: false},
+			{Height: 5, PeerId: "", HasBlock: true},
+		},
+	}, window)
+}
+
+// fakeRateMonitor reports a fixed rate.
+type fakeRateMonitor struct {
+	rate int64
+	rEMA float64 // the last seed set
+}
+
+func (m *fakeRateMonitor) Update(n int) int     { return n }
+func (m *fakeRateMonitor) SetREMA(rEMA float64) { m.rEMA = rEMA }
+func (m *fakeRateMonitor) Status() flow.Status  { return flow.Status{CurRate: m.rate} }
+
+func TestBlockPoolRecvRateSeed(t *testing.T) {
+	for _, multiplier := range []float64{math.E, 10} {
+		options := []BlockPoolOption{}
+		if multiplier != math.E {
+			options = append(options, WithRecvRateSeed(multiplier))
+		}
+		pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError), options...)
+		require.NoError(t, err)
+		pool.SetLogger(log.TestingLogger())
+
+		monitor := &fakeRateMonitor{}
+		pool.newRecvMonitor = func() rateMonitor { return monitor }
+		pool.SetPeerRange("peer", 1, 10)
+		peer := pool.pickIncrAvailablePeer(1, nil)
+		require.NotNil(t, peer)
+		peer.timeout.Stop()
+
+		assert.Equal(t, float64(minRecvRate)*multiplier, monitor.rEMA)
+	}
+}
+
+func TestBlockPoolRateCheckGracePeriod(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.newRecvMonitor = func() rateMonitor { return &fakeRateMonitor{rate: minRecvRate / 10} }
+
+	pool.SetPeerRange("peer", 1, 10)
+	peer := pool.pickIncrAvailablePeer(1, nil)
+	require.NotNil(t, peer)
+	t.Cleanup(func() { peer.timeout.Stop() })
+
+	// a freshly added peer isn't judged by its rate yet.
+	pool.removeTimedoutPeers()
+	assert.Contains(t, pool.peers, peer.id)
+
+	peer.addedAt = time.Now().Add(-defaultRateCheckGracePeriod)
+	pool.removeTimedoutPeers()
+	assert.NotContains(t, pool.peers, peer.id)
+}
+
+func TestBlockPoolMinRecvRate(t *testing.T) {
+	errorsCh := make(chan peerError, 10)
+	pool := newTestPool(t, make(chan BlockRequest), errorsCh)
+
+	rates := map[p2p.ID]int64{
+		"slow":   minRecvRate - 1,
+		"atRate": minRecvRate,
+		"fast":   minRecvRate + 1,
+	}
+	for peerID, rate := range rates {
+		pool.SetPeerRange(peerID, 1, 10)
+		peer := pool.peers[peerID]
+		peer.incrPending()
+		t.Cleanup(func() { peer.timeout.Stop() })
+		peer.addedAt = time.Now().Add(-defaultRateCheckGracePeriod)
+		peer.recvMonitor = &fakeRateMonitor{rate: rate}
+	}
+
+	pool.removeTimedoutPeers()
+	assert.NotContains(t, pool.peers, p2p.ID("slow"))
+	assert.Contains(t, pool.peers, p2p.ID("atRate"))
+	assert.Contains(t, pool.peers, p2p.ID("fast"))
+	require.Len(t, errorsCh, 1)
+	perr := <-errorsCh
+	assert.EqualValues(t, "slow", perr.peerID)
+	assert.Equal(t, PeerErrorTooSlow, perr.reason)
+}
+
+type lastPeerSelector struct{}
+
+func (lastPeerSelector) Select(candidates []PeerInfo, height int64) (p2p.ID, bool) {
+	last := candidates[0].ID
+	for _, c := range candidates {
+		if c.ID > last {
+			last = c.ID
+		}
+	}
+	return last, true
+}
+
+type noPeerSelector struct{}
+
+func (noPeerSelector) Select(candidates []PeerInfo, height int64) (p2p.ID, bool) {
+	return "", false
+}
+
+func TestBlockPoolPeerSelector(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError), WithPeerSelector(lastPeerSelector{}))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("a", 1, 10)
+	pool.SetPeerRange("b", 1, 10)
+	pool.SetPeerRange("c", 1, 4) // not eligible for height 5
+
+	peer := pool.pickIncrAvailablePeer(5, nil)
+	require.NotNil(t, peer)
+	t.Cleanup(func() { peer.timeout.Stop() })
+	assert.EqualValues(t, "b", peer.id)
+	assert.EqualValues(t, 1, peer.numPending)
+
+	pool.peerSelector = noPeerSelector{}
+	assert.Nil(t, pool.pickIncrAvailablePeer(5, nil))
+}
+
+func TestBlockPoolWastedBytes(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	pool.SetPeerRange("bad", 1, 1)
+	request := <-requestsCh
+	pool.AddBlock(request.PeerID, &types.Block{Header: types.Header{Height: 1}}, 1000)
+	assert.Zero(t, pool.WastedBytes())
+
+	// the block turns out to be invalid.
+	pool.RedoRequest(1)
+	require.Eventually(t, func() bool {
+		return pool.WastedBytes() == 1000
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBlockPoolTotalBytesDownloaded(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10))
+
+	sizes := map[int64]int{1: 1000, 2: 2500, 3: 400}
+	pool.SetPeerRange("peer", 1, 3)
+	for range sizes {
+		request := <-requestsCh
+		block := &types.Block{Header: types.Header{Height: request.Height}}
+		pool.AddBlock(request.PeerID, block, sizes[request.Height])
+	}
+	assert.EqualValues(t, 3900, pool.TotalBytesDownloaded())
+
+	// rejected blocks were downloaded too.
+	pool.AddBlock("peer", &types.Block{Header: types.Header{Height: 2}}, 2500)
+	assert.EqualValues(t, 6400, pool.TotalBytesDownloaded())
+	pool.AddBlock("peer", &types.Block{Header: types.Header{Height: 1000}}, 100)
+	assert.EqualValues(t, 6500, pool.TotalBytesDownloaded())
+}
+
+func TestBlockPoolPinRequest(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool, err := NewBlockPool(1, requestsCh, errorsCh)
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	require.NoError(t, pool.PinRequest(3, "pinned"))
+	err = pool.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := pool.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	pool.SetPeerRange("other", 1, 3)
+	pool.SetPeerRange("pinned", 3, 3)
+	for i := 0; i < 3; i++ {
+		request := <-requestsCh
+		if request.Height == 3 {
+			assert.EqualValues(t, "pinned", request.PeerID)
+		} else {
+			assert.EqualValues(t, "other", request.PeerID)
+		}
+	}
+	assert.Error(t, pool.PinRequest(1, "pinned"), "already requested from another peer")
+
+	// the height is never requested from another peer.
+	pool.RemovePeer("pinned")
+	select {
+	case err := <-errorsCh:
+		assert.Equal(t, ErrPinnedPeerRemoved{Height: 3, PeerID: "pinned"}, err.err)
+		assert.Equal(t, PeerErrorNoResponse, err.reason)
+	case <-time.After(time.Second):
+		t.Fatal("expected pinned peer removal to be reported")
+	}
+	select {
+	case request := <-requestsCh:
+		t.Fatalf("unexpected request %v", request)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pool.SetPeerRange("pinned", 3, 3)
+	assert.Equal(t, BlockRequest{3, "pinned"}, <-requestsCh)
+}
+
+func TestBlockPoolCaughtUpHysteresis(t *testing.T) {
+	pool, err := NewBlockPool(10, make(chan BlockRequest), make(chan peerError), WithCaughtUpChecks(3))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	// a taller peer keeps coming and going, so we're caught up every other
+	// check.
+	pool.SetPeerRange("peer", 1, 11)
+	for i := 0; i < 5; i++ {
+		assert.False(t, pool.IsCaughtUp())
+		pool.SetPeerRange("taller", 1, 12)
+		assert.False(t, pool.IsCaughtUp())
+		pool.RemovePeer("taller")
+	}
+	assert.Equal(t, 5, pool.CaughtUpFlaps())
+
+	// the taller peer is gone for good.
+	assert.False(t, pool.IsCaughtUp())
+	assert.False(t, pool.IsCaughtUp())
+	assert.True(t, pool.IsCaughtUp())
+	assert.Equal(t, 5, pool.CaughtUpFlaps())
+}
+
+func TestBlockPoolCommitVerifier(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	errInvalid := errors.New("invalid commit")
+	pool := newTestPool(t, requestsCh, errorsCh,
+		WithCommitVerifier(func(block *types.Block, commitFromNext *types.Commit) error {
+			if block.Height == 1 {
+				return errInvalid
+			}
+			return nil
+		}))
+
+	pool.SetPeerRange("bad", 1, 2)
+	for i := 0; i < 2; i++ {
+		request := <-requestsCh
+		block := &types.Block{Header: types.Header{Height: request.Height}, LastCommit: &types.Commit{}}
+		pool.AddBlock(request.PeerID, block, 123)
+	}
+
+	err := pool.PopRequest()
+	require.ErrorIs(t, err, errInvalid)
+	height, _, _ := pool.GetStatus()
+	assert.EqualValues(t, 1, height, "the pool must not advance")
+	assert.NotContains(t, pool.peers, p2p.ID("bad"))
+	select {
+	case err := <-errorsCh:
+		assert.EqualValues(t, "bad", err.peerID)
+		assert.Equal(t, PeerErrorBadBlock, err.reason)
+	case <-time.After(time.Second):
+		t.Fatal("expected the peer to be reported")
+	}
+}
+
+func TestBlockPoolFailedPeersSkipped(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	requester := newBPRequester(pool, 1)
+	pool.requesters[1] = requester
+
+	pool.SetPeerRange("flapping", 1, 10)
+	requester.peerID = "flapping"
+	pool.RemovePeer("flapping")
+	pool.SetPeerRange("flapping", 1, 10)
+	t.Cleanup(func() {
+		for _, peer := range pool.peers {
+			if peer.timeout != nil {
+				peer.timeout.Stop()
+			}
+		}
+	})
+
+	// the flapping peer is still picked if it's the only one.
+	peer := pool.pickIncrAvailablePeer(1, requester.getFailedPeers())
+	require.NotNil(t, peer)
+	assert.EqualValues(t, "flapping", peer.id)
+
+	pool.SetPeerRange("good", 1, 10)
+	for i := 0; i < 10; i++ {
+		peer := pool.pickIncrAvailablePeer(1, requester.getFailedPeers())
+		require.NotNil(t, peer)
+		assert.EqualValues(t, "good", peer.id)
+	}
+
+	// once the height is served, the flapping peer is eligible again.
+	requester.peerID = "good"
+	require.True(t, requester.setBlock(&types.Block{Header: types.Header{Height: 1}}, 123, "good"))
+	assert.Empty(t, requester.getFailedPeers())
+}
+
+func TestBlockPoolProgress(t *testing.T) {
+	pool, err := NewBlockPool(11, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	// no peers, nothing to sync.
+	assert.EqualValues(t, 1, pool.Progress())
+
+	pool.SetPeerRange("peer", 1, 11)
+	assert.EqualValues(t, 1, pool.Progress())
+
+	pool.SetPeerRange("peer", 1, 51)
+	assert.EqualValues(t, 0, pool.Progress())
+
+	pool.height = 21
+	assert.EqualValues(t, 0.25, pool.Progress())
+
+	pool.height = 51
+	assert.EqualValues(t, 1, pool.Progress())
+}
+
+func TestBlockPoolUptime(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	assert.True(t, pool.StartedAt().IsZero())
+	assert.Zero(t, pool.Uptime())
+
+	before := time.Now()
+	err = pool.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := pool.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	assert.False(t, pool.StartedAt().Before(before))
+	time.Sleep(10 * time.Millisecond)
+	assert.GreaterOrEqual(t, int64(pool.Uptime()), int64(10*time.Millisecond))
+}
+
+func TestBlockPoolNotifyChannelsClosed(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	pool.NotifyChannelsClosed()
+	close(requestsCh)
+	close(errorsCh)
+
+	assert.NotPanics(t, func() {
+		pool.sendRequest(1, "peer")
+		pool.sendError(errors.New("bad peer"), "peer", PeerErrorBadBlock)
+	})
+}
+
+func TestBlockPoolNotifyChannelsClosedDuringSend(t *testing.T) {
+	requestsCh := make(chan BlockRequest)
+	errorsCh := make(chan peerError)
+
+	pool, err := NewBlockPool(1, requestsCh, errorsCh)
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	pool.SetChannelWatchdog(time.Hour) // to count the blocked sends
+	err = pool.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := pool.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// nobody reads the channels, so both sends block.
+	done := make(chan struct{}, 2)
+	go func() {
+		pool.sendRequest(1, "peer")
+		done <- struct{}{}
+	}()
+	go func() {
+		pool.sendError(errors.New("bad peer"), "peer", PeerErrorBadBlock)
+		done <- struct{}{}
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&pool.numBlockedSends) == 2
+	}, time.Second, time.Millisecond)
+
+	pool.NotifyChannelsClosed()
+	close(requestsCh)
+	close(errorsCh)
+	<-done
+	<-done
+}
+
+func TestBlockPoolPeersAhead(t *testing.T) {
+	pool, err := NewBlockPool(10, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	assert.Zero(t, pool.PeersAhead())
+	peerID, height := pool.HighestPeer()
+	assert.EqualValues(t, "", peerID)
+	assert.Zero(t, height)
+
+	pool.SetPeerRange("behind", 1, 9)
+	pool.SetPeerRange("level", 1, 10)
+	pool.SetPeerRange("b", 1, 20)
+	pool.SetPeerRange("a", 1, 20)
+
+	assert.Equal(t, 2, pool.PeersAhead())
+	peerID, height = pool.HighestPeer()
+	assert.EqualValues(t, "a", peerID)
+	assert.EqualValues(t, 20, height)
+}
+
+func TestBlockPoolPeerHeightDecreased(t *testing.T) {
+	testCases := []struct {
+		policy         HeightDecreasePolicy
+		expectedHeight int64 // 0 means the peer is removed
+	}{
+		{HeightDecreaseAccept, 5},
+		{HeightDecreaseReject, 10},
+		{HeightDecreaseDisconnect, 0},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(fmt.Sprintf("policy=%d", tc.policy), func(t *testing.T) {
+			errorsCh := make(chan peerError, 1)
+			pool := newTestPool(t, make(chan BlockRequest), errorsCh, WithHeightDecreasePolicy(tc.policy))
+
+			pool.SetPeerRange("peer", 1, 10)
+			pool.SetPeerRange("peer", 1, 5)
+			pool.mtx.Lock()
+			peer := pool.peers["peer"]
+			pool.mtx.Unlock()
+
+			if tc.expectedHeight == 0 {
+				assert.Nil(t, peer)
+				select {
+				case err := <-errorsCh:
+					assert.EqualValues(t, "peer", err.peerID)
+					assert.ErrorAs(t, err.err, &ErrPeerHeightDecreased{})
+					assert.Equal(t, PeerErrorBadStatus, err.reason)
+				default:
+					t.Fatal("expected the peer to be reported")
+				}
+				return
+			}
+			require.NotNil(t, peer)
+			assert.Equal(t, tc.expectedHeight, peer.height)
+		})
+	}
+}
+
+func TestBlockPoolTrustedMaxPeerHeight(t *testing.T) {
+	requestsCh := make(chan BlockRequest, maxTotalRequesters)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10), WithTrustedMaxPeerHeight(true))
+
+	pool.SetPeerRange("honest", 1, 10)
+	request := <-requestsCh
+	require.EqualValues(t, "honest", request.PeerID)
+	// the liar never delivers anything.
+	pool.SetPeerRange("liar", 1, 1000000)
+
+	assert.EqualValues(t, 1000000, pool.ReportedMaxHeight())
+	assert.Zero(t, pool.MaxPeerHeight())
+
+	pool.AddBlock("honest", &types.Block{Header: types.Header{Height: request.Height}}, 123)
+	assert.EqualValues(t, 10, pool.MaxPeerHeight())
+	assert.EqualValues(t, 1000000, pool.ReportedMaxHeight())
+
+	pool.RemovePeer("honest")
+	assert.Zero(t, pool.MaxPeerHeight())
+	assert.EqualValues(t, 1000000, pool.ReportedMaxHeight())
+}
+
+func TestBlockPoolOnPeerAdd(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError),
+		WithOnPeerAdd(func(peerID p2p.ID, base, height int64) PeerAdmission {
+			if peerID == "banned" {
+				return PeerRefused
+			}
+			return PeerAccepted
+		}))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("banned", 1, 10)
+	pool.SetPeerRange("allowed", 1, 5)
+	assert.False(t, pool.hasPeer("banned"))
+	assert.True(t, pool.hasPeer("allowed"))
+	assert.EqualValues(t, 5, pool.MaxPeerHeight())
+}
+
+func TestBlockPoolUntrustedPeers(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	numCalls := 0
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10),
+		WithOnPeerAdd(func(peerID p2p.ID, base, height int64) PeerAdmission {
+			numCalls++
+			if peerID == "trusted" {
+				return PeerAccepted
+			}
+			return PeerUntrusted
+		}))
+
+	pool.SetPeerRange("untrusted", 1, 10)
+	pool.SetPeerRange("trusted", 1, 5)
+	assert.EqualValues(t, 10, pool.MaxPeerHeight())
+	assert.Equal(t, map[p2p.ID]string{"untrusted": ineligibleUntrusted}, pool.WhyNotEligible(1))
+
+	for i := 0; i < 5; i++ {
+		request := <-requestsCh
+		assert.EqualValues(t, "trusted", request.PeerID)
+	}
+	// the flag is taken once, when the peer is added.
+	pool.SetPeerRange("untrusted", 1, 11)
+	pool.mtx.Lock()
+	assert.Equal(t, 2, numCalls)
+	pool.mtx.Unlock()
+	// the heights above the trusted peer's aren't requested from anyone.
+	select {
+	case request := <-requestsCh:
+		t.Fatalf("unexpected request %v", request)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBlockPoolOnNoPeers(t *testing.T) {
+	numCalls := 0
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError),
+		WithOnNoPeers(func() { numCalls++ }))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("a", 1, 10)
+	pool.SetPeerRange("b", 1, 10)
+	pool.RemovePeer("a")
+	assert.Zero(t, numCalls)
+	pool.RemovePeer("b")
+	assert.Equal(t, 1, numCalls)
+
+	// caught up already.
+	pool.SetPeerRange("c", 1, 2)
+	pool.RemovePeer("c")
+	assert.Equal(t, 1, numCalls)
+}
+
+func TestBlockPoolExportImportPeers(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("b", 5, 20)
+	pool.SetPeerRange("a", 1, 10)
+	peer := pool.pickIncrAvailablePeer(5, nil)
+	require.NotNil(t, peer)
+	peer.timeout.Stop()
+
+	snapshots := pool.ExportPeers()
+	assert.Equal(t, []PeerSnapshot{{"a", 1, 10}, {"b", 5, 20}}, snapshots)
+
+	restored, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	restored.SetLogger(log.TestingLogger())
+	restored.SetPeerRange("a", 1, 15) // more recent than the snapshot
+	restored.ImportPeers(snapshots)
+
+	assert.Equal(t, []PeerSnapshot{{"a", 1, 15}, {"b", 5, 20}}, restored.ExportPeers())
+	assert.EqualValues(t, 20, restored.MaxPeerHeight())
+	for _, peer := range restored.peers {
+		assert.Zero(t, peer.numPending)
+		assert.Nil(t, peer.recvMonitor)
+	}
+}
+
+func TestBlockPoolErrorRateLimit(t *testing.T) {
+	errorsCh := make(chan peerError, 1000)
+	pool := newTestPool(t, make(chan BlockRequest, maxTotalRequesters), errorsCh,
+		WithErrorRateLimit(time.Hour, 5))
+	pool.SetPeerRange("flooding", 1, 1)
+	pool.SetPeerRange("other", 1, 1)
+
+	errInvalid := errors.New("invalid peer")
+	pool.mtx.Lock()
+	for i := 0; i < 1000; i++ {
+		pool.sendError(errInvalid, "flooding", PeerErrorBlockMismatch)
+	}
+	pool.sendError(errInvalid, "other", PeerErrorBlockMismatch)
+	pool.mtx.Unlock()
+	require.Len(t, errorsCh, 6)
+	for i := 0; i < 5; i++ {
+		err := <-errorsCh
+		assert.EqualValues(t, "flooding", err.peerID)
+		assert.Equal(t, errInvalid, err.err)
+	}
+	assert.EqualValues(t, "other", (<-errorsCh).peerID)
+
+	// once the window ends, the dropped errors are reported along with the
+	// next one.
+	pool.mtx.Lock()
+	pool.errorLimits["flooding"].windowStart = time.Now().Add(-time.Hour)
+	pool.sendError(errInvalid, "flooding", PeerErrorBlockMismatch)
+	pool.mtx.Unlock()
+	require.Len(t, errorsCh, 1)
+	err := (<-errorsCh).err
+	assert.Equal(t, ErrCoalesced{Err: errInvalid, NumSuppressed: 995}, err)
+	assert.ErrorIs(t, err, errInvalid)
+
+	// no state is kept for peers which aren't in the pool.
+	pool.RemovePeer("flooding")
+	pool.mtx.Lock()
+	for i := 0; i < 10; i++ {
+		pool.sendError(errInvalid, "flooding", PeerErrorBlockMismatch)
+		pool.sendError(errInvalid, "unknown", PeerErrorBlockMismatch)
+	}
+	pool.mtx.Unlock()
+	assert.Len(t, errorsCh, 20)
+	pool.errorLimitsMtx.Lock()
+	assert.Len(t, pool.errorLimits, 1)
+	pool.errorLimitsMtx.Unlock()
+}
+
+func TestBlockPoolDuplicateBlocks(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	pool.SetPeerRange("peer", 1, 1)
+	request := <-requestsCh
+	block := &types.Block{Header: types.Header{Height: request.Height}}
+	pool.AddBlock(request.PeerID, block, 123)
+	require.Empty(t, errorsCh)
+
+	pool.AddBlock(request.PeerID, block, 123)
+	select {
+	case err := <-errorsCh:
+		assert.EqualValues(t, "peer", err.peerID)
+		assert.Equal(t, PeerErrorDuplicate, err.reason)
+	case <-time.After(time.Second):
+		t.Fatal("expected the duplicate to be reported")
+	}
+	assert.True(t, pool.hasPeer("peer"), "a single duplicate is tolerated")
+
+	for i := 0; i < maxDuplicateBlocks; i++ {
+		pool.AddBlock(request.PeerID, block, 123)
+	}
+	assert.False(t, pool.hasPeer("peer"))
+}
+
+func TestBlockPoolPendingPerPeer(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("busy", 1, 10)
+	pool.SetPeerRange("idle", 1, 10)
+	busy := pool.peers["busy"]
+	busy.incrPending()
+	busy.incrPending()
+	t.Cleanup(func() { busy.timeout.Stop() })
+
+	pending := pool.PendingPerPeer()
+	assert.Equal(t, map[p2p.ID]int32{"busy": 2, "idle": 0}, pending)
+
+	// it's a copy.
+	pending["busy"] = 0
+	assert.EqualValues(t, 2, pool.PendingPerPeer()["busy"])
+}
+
+func TestBlockPoolPeerIdleDurations(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("active", 1, 10)
+	pool.SetPeerRange("idle", 1, 10)
+	pool.peers["idle"].lastDeliveryAt = time.Now().Add(-time.Minute)
+	active := pool.peers["active"]
+	active.lastDeliveryAt = time.Now().Add(-time.Minute)
+	active.incrPending()
+	active.incrPending()
+	active.decrPending(123)
+	t.Cleanup(func() { active.timeout.Stop() })
+
+	idle := pool.PeerIdleDurations()
+	require.Len(t, idle, 2)
+	assert.Less(t, int64(idle["active"]), int64(time.Minute))
+	assert.GreaterOrEqual(t, int64(idle["idle"]), int64(time.Minute))
+}
+
+func TestBlockPoolPause(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 100)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10))
+
+	pool.SetPeerRange("peer", 1, 2)
+	require.Eventually(t, func() bool {
+		_, _, lenRequesters := pool.GetStatus()
+		return lenRequesters == 2
+	}, time.Second, 10*time.Millisecond)
+
+	pool.Pause()
+	assert.True(t, pool.IsPaused())
+	pool.SetPeerRange("peer", 1, 10)
+	time.Sleep(100 * time.Millisecond)
+	_, _, lenRequesters := pool.GetStatus()
+	assert.Equal(t, 2, lenRequesters, "no new requesters while paused")
+
+	pool.Resume()
+	assert.False(t, pool.IsPaused())
+	require.Eventually(t, func() bool {
+		_, _, lenRequesters := pool.GetStatus()
+		return lenRequesters == 10
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBlockPoolOnBlockPopped(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	var popped []int64
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10),
+		WithOnBlockPopped(func(block *types.Block) {
+			popped = append(popped, block.Height)
+		}))
+
+	pool.SetPeerRange("peer", 1, 5)
+	for i := 0; i < 5; i++ {
+		request := <-requestsCh
+		block := &types.Block{Header: types.Header{Height: request.Height}}
+		pool.AddBlock(request.PeerID, block, 123)
+	}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, pool.PopRequest())
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, popped)
+}
+
+func TestBlockPoolPeerTimeoutJitter(t *testing.T) {
+	jitter := 0.0
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError),
+		WithJitterSource(func() float64 { return jitter }))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("peer", 1, 10)
+	peer := pool.peers["peer"]
+	peer.incrPending()
+	t.Cleanup(func() { peer.timeout.Stop() })
+	assert.Equal(t, peerTimeout, peer.curTimeout)
+
+	jitter = 0.5
+	peer.resetTimeout()
+	assert.Equal(t, peerTimeout+time.Duration(float64(peerTimeout)*peerTimeoutJitter/2), peer.curTimeout)
+}
+
+func TestBlockPoolMaxBlockBytes(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh, WithMaxBlockBytes(1000))
+
+	pool.SetPeerRange("peer", 1, 1)
+	request := <-requestsCh
+	block := &types.Block{Header: types.Header{Height: request.Height}}
+	pool.AddBlock(request.PeerID, block, 1001)
+
+	select {
+	case err := <-errorsCh:
+		assert.EqualValues(t, "peer", err.peerID)
+		assert.Equal(t, PeerErrorOversized, err.reason)
+	case <-time.After(time.Second):
+		t.Fatal("expected the peer to be reported")
+	}
+	first, _, _ := pool.PeekTwoBlocks()
+	assert.Nil(t, first, "the block must be dropped")
+	assert.EqualValues(t, 1001, pool.WastedBytes())
+	assert.EqualValues(t, 1001, pool.TotalBytesDownloaded())
+
+	// the block is requested again.
+	select {
+	case request := <-requestsCh:
+		assert.EqualValues(t, 1, request.Height)
+	case <-time.After(time.Second):
+		t.Fatal("expected the block to be requested again")
+	}
+}
+
+func TestBlockPoolInvalidPeerRange(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("inverted", 10, 5)
+	pool.SetPeerRange("negative", -1, 5)
+	assert.Empty(t, pool.peers)
+	assert.Zero(t, pool.MaxPeerHeight())
+
+	// a known peer keeps its previous range.
+	pool.SetPeerRange("peer", 1, 10)
+	pool.SetPeerRange("peer", 20, 10)
+	assert.EqualValues(t, 1, pool.peers["peer"].base)
+	assert.EqualValues(t, 10, pool.peers["peer"].height)
+}
+
+func TestBlockPoolSkipHeight(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10))
+
+	pool.SetPeerRange("peer", 1, 2)
+	requests := map[int64]BlockRequest{}
+	for i := 0; i < 2; i++ {
+		request := <-requestsCh
+		requests[request.Height] = request
+	}
+	// the block at height 2 arrives, the one at height 1 never does.
+	request := requests[2]
+	pool.AddBlock(request.PeerID, &types.Block{Header: types.Header{Height: 2}}, 123)
+
+	assert.Error(t, pool.SkipHeight(2), "only the pool's height can be skipped")
+	require.NoError(t, pool.SkipHeight(1))
+	assert.Equal(t, []int64{1}, pool.SkippedHeights())
+
+	height, numPending, lenRequesters := pool.GetStatus()
+	assert.EqualValues(t, 2, height)
+	assert.Zero(t, numPending)
+	assert.Equal(t, 1, lenRequesters)
+	assert.Zero(t, pool.peers["peer"].numPending)
+
+	assert.Error(t, pool.SkipHeight(2), "a block which has arrived can't be skipped")
+	require.NoError(t, pool.PopRequest())
+}
+
+func TestBlockPoolMaxDeliveryReorder(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh, WithMaxDeliveryReorder(5))
+
+	pool.SetPeerRange("peer", 1, 10)
+	for i := 0; i < 10; i++ {
+		<-requestsCh
+	}
+
+	for _, height := range []int64{10, 9, 5} {
+		pool.AddBlock("peer", &types.Block{Header: types.Header{Height: height}}, 123)
+	}
+	assert.Empty(t, errorsCh)
+
+	pool.AddBlock("peer", &types.Block{Header: types.Header{Height: 4}}, 123)
+	select {
+	case err := <-errorsCh:
+		assert.EqualValues(t, "peer", err.peerID)
+		assert.Equal(t, PeerErrorOutOfOrder, err.reason)
+	case <-time.After(time.Second):
+		t.Fatal("expected the peer to be reported")
+	}
+
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	assert.Nil(t, pool.requesters[4].getBlock())
+	assert.NotNil(t, pool.requesters[5].getBlock())
+}
+
+func TestBlockPoolUnexpectedBlockReasons(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	pool.SetPeerRange("peer", 1, 1)
+	request := <-requestsCh
+
+	// from a peer it wasn't requested from.
+	pool.AddBlock("other", &types.Block{Header: types.Header{Height: request.Height}}, 123)
+	// too far ahead.
+	pool.AddBlock("peer", &types.Block{Header: types.Header{Height: 1000}}, 123)
+
+	for _, peerID := range []p2p.ID{"other", "peer"} {
+		select {
+		case err := <-errorsCh:
+			assert.Equal(t, peerID, err.peerID)
+			assert.Equal(t, PeerErrorBlockMismatch, err.reason)
+		case <-time.After(time.Second):
+			t.Fatal("expected the peer to be reported")
+		}
+	}
+}
+
+func TestBlockPoolMismatchedBlockHeight(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	// only "a" has height 1 and only "b" has height 2.
+	pool.SetPeerRange("a", 1, 1)
+	pool.SetPeerRange("b", 2, 2)
+	requested := make(map[int64]p2p.ID)
+	for len(requested) < 2 {
+		request := <-requestsCh
+		requested[request.Height] = request.PeerID
+	}
+	require.Equal(t, map[int64]p2p.ID{1: "a", 2: "b"}, requested)
+
+	// "a" answers the request for height 1 with the block at height 2, which
+	// it wasn't asked for.
+	pool.AddBlock("a", &types.Block{Header: types.Header{Height: 2}}, 123)
+	select {
+	case err := <-errorsCh:
+		assert.EqualValues(t, "a", err.peerID)
+		assert.Equal(t, PeerErrorBlockMismatch, err.reason)
+		assert.EqualError(t, err.err, "block 2 wasn't requested from the peer")
+	case <-time.After(time.Second):
+		t.Fatal("expected the peer to be reported")
+	}
+	pool.mtx.Lock()
+	assert.Nil(t, pool.requesters[1].getBlock())
+	assert.Nil(t, pool.requesters[2].getBlock())
+	pool.mtx.Unlock()
+
+	// the block is still accepted from "b".
+	pool.AddBlock("b", &types.Block{Header: types.Header{Height: 2}}, 123)
+	pool.mtx.Lock()
+	assert.NotNil(t, pool.requesters[2].getBlock())
+	pool.mtx.Unlock()
+	assert.Empty(t, errorsCh)
+}
+
+func TestBlockPoolRedoTwice(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10))
+
+	pool.SetPeerRange("a", 1, 1)
+	request := <-requestsCh
+	require.EqualValues(t, "a", request.PeerID)
+	pool.SetPeerRange("b", 1, 1)
+
+	pool.mtx.Lock()
+	requester := pool.requesters[1]
+	pool.mtx.Unlock()
+	requester.redo("a")
+	requester.redo("a")
+
+	select {
+	case request := <-requestsCh:
+		assert.EqualValues(t, "b", request.PeerID)
+	case <-time.After(time.Second):
+		t.Fatal("expected the block to be requested again")
+	}
+	select {
+	case request := <-requestsCh:
+		t.Fatalf("the redo was processed twice: %v", request)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.EqualValues(t, "b", requester.getPeerID())
+}
+
+func TestBlockPoolOnRequesterReassigned(t *testing.T) {
+	type reassignment struct {
+		height   int64
+		from, to p2p.ID
+	}
+	reassigned := make(chan reassignment, 10)
+
+	requestsCh := make(chan BlockRequest, 10)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10),
+		WithOnRequesterReassigned(func(height int64, from, to p2p.ID) {
+			reassigned <- reassignment{height, from, to}
+		}))
+
+	pool.SetPeerRange("a", 1, 1)
+	request := <-requestsCh
+	require.EqualValues(t, "a", request.PeerID)
+	pool.SetPeerRange("b", 1, 1)
+	pool.RemovePeer("a")
+
+	select {
+	case r := <-reassigned:
+		assert.Equal(t, reassignment{1, "a", "b"}, r)
+	case <-time.After(time.Second):
+		t.Fatal("expected the requester to be reassigned")
+	}
+}
+
+func TestBlockPoolPeerReputation(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10))
+
+	pool.SetPeerRange("peer", 1, 1)
+	request := <-requestsCh
+	assert.Equal(t, map[p2p.ID]Reputation{"peer": {}}, pool.PeerReputation())
+
+	time.Sleep(20 * time.Millisecond)
+	block := &types.Block{Header: types.Header{Height: request.Height}}
+	pool.AddBlock(request.PeerID, block, 123)
+	reputation := pool.PeerReputation()["peer"]
+	assert.Equal(t, 1, reputation.NumDelivered)
+	assert.GreaterOrEqual(t, reputation.AvgLatency, 20*time.Millisecond)
+
+	// a duplicate is rejected.
+	pool.AddBlock(request.PeerID, block, 123)
+	// the peer stops sending anything.
+	pool.peers["peer"].onTimeout()
+
+	reputation = pool.PeerReputation()["peer"]
+	assert.Equal(t, 1, reputation.NumDelivered)
+	assert.Equal(t, 1, reputation.NumRejected)
+	assert.Equal(t, 1, reputation.NumTimeouts)
+}
+
+func TestBlockPoolBlockProvider(t *testing.T) {
+	pool := newTestPool(t, make(chan BlockRequest), make(chan peerError, 10),
+		WithBlockProvider(func(height int64) (*types.Block, error) {
+			return &types.Block{Header: types.Header{Height: height}}, nil
+		}))
+
+	pool.SetPeerRange("simulated", 1, 5)
+	for height := int64(1); height <= 5; height++ {
+		require.Eventually(t, func() bool {
+			first, _, _ := pool.PeekTwoBlocks()
+			return first != nil
+		}, time.Second, time.Millisecond)
+		first, _, _ := pool.PeekTwoBlocks()
+		assert.Equal(t, height, first.Height)
+		require.NoError(t, pool.PopRequest())
+	}
+}
+
+func TestBlockPoolRemovePinnedPeerErrorsCombined(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 100)
+	errorsCh := make(chan peerError, 100)
+	pool := newTestPool(t, requestsCh, errorsCh)
+
+	for height := int64(1); height <= 50; height++ {
+		require.NoError(t, pool.PinRequest(height, "peer"))
+	}
+	pool.SetPeerRange("peer", 1, 50)
+	for i := 0; i < 50; i++ {
+		<-requestsCh
+	}
+
+	pool.RemovePeer("peer")
+	require.Len(t, errorsCh, 1)
+	perr := <-errorsCh
+	var multi MultiError
+	require.ErrorAs(t, perr.err, &multi)
+	require.Len(t, multi.Errors, 50)
+	for i, err := range multi.Errors {
+		assert.Equal(t, ErrPinnedPeerRemoved{Height: int64(i + 1), PeerID: "peer"}, err)
+	}
+}
+
+func TestBlockPoolPausePeer(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	assert.Error(t, pool.PausePeer("unknown"))
+
+	pool.SetPeerRange("peer", 1, 10)
+	require.NoError(t, pool.PausePeer("peer"))
+	assert.Nil(t, pool.pickIncrAvailablePeer(1, nil))
+	assert.Equal(t, map[p2p.ID]string{"peer": "paused"}, pool.WhyNotEligible(1))
+	assert.Contains(t, pool.peers, p2p.ID("peer"), "a paused peer isn't removed")
+	assert.EqualValues(t, 10, pool.MaxPeerHeight())
+
+	require.NoError(t, pool.ResumePeer("peer"))
+	peer := pool.pickIncrAvailablePeer(1, nil)
+	require.NotNil(t, peer)
+	peer.timeout.Stop()
+	assert.EqualValues(t, "peer", peer.id)
+}
+
+func TestBlockPoolNearMaxHeight(t *testing.T) {
+	const start int64 = math.MaxInt64 - 2
+	requestsCh := make(chan BlockRequest, 10)
+	pool, err := NewBlockPool(start, requestsCh, make(chan peerError, 10))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	err = pool.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := pool.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	pool.SetPeerRange("peer", 1, math.MaxInt64)
+
+	requested := make(map[int64]bool)
+	for i := 0; i < 3; i++ {
+		request := <-requestsCh
+		requested[request.Height] = true
+	}
+	assert.Equal(t, map[int64]bool{start: true, start + 1: true, math.MaxInt64: true}, requested)
+
+	assert.False(t, pool.makeNextRequester())
+	pool.mtx.Lock()
+	_, ok := pool.nextRequesterHeight()
+	assert.False(t, ok)
+	assert.Len(t, pool.requesters, 3)
+	pool.mtx.Unlock()
+	assert.Contains(t, pool.DebugString(), fmt.Sprintf("H(%v)", start+1))
+}
+
+func TestBlockPoolMaxPeerHeightMonotonic(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	pool.SetPeerRange("a", 1, 20)
+	pool.SetPeerRange("b", 1, 15)
+
+	// a stale height doesn't lower the target.
+	pool.SetPeerRange("a", 1, 10)
+	assert.EqualValues(t, 20, pool.MaxPeerHeight())
+	pool.SetPeerRange("a", 1, 25)
+	assert.EqualValues(t, 25, pool.MaxPeerHeight())
+
+	// neither does removing a peer which didn't report it.
+	pool.RemovePeer("b")
+	assert.EqualValues(t, 25, pool.MaxPeerHeight())
+
+	// removing the peer which did lowers it, even if it then reported less.
+	pool.SetPeerRange("b", 1, 15)
+	pool.SetPeerRange("a", 1, 5)
+	pool.RemovePeer("a")
+	assert.EqualValues(t, 15, pool.MaxPeerHeight())
+}
+
+func TestBlockPoolPeerForHeight(t *testing.T) {
+	requestsCh := make(chan BlockRequest)
+	pool := newTestPool(t, requestsCh, make(chan peerError))
+
+	_, ok := pool.PeerForHeight(1)
+	assert.False(t, ok)
+
+	pool.SetPeerRange("peer", 1, 1)
+	request := <-requestsCh
+	peerID, ok := pool.PeerForHeight(request.Height)
+	assert.True(t, ok)
+	assert.EqualValues(t, "peer", peerID)
+
+	// the peer is gone, so the requester waits for another one.
+	pool.RemovePeer("peer")
+	assert.Eventually(t, func() bool {
+		_, ok := pool.PeerForHeight(request.Height)
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBlockPoolSlowPeerProbation(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError, 10),
+		WithSlowPeerProbation(time.Minute))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	monitor := &fakeRateMonitor{rate: minRecvRate / 10}
+	pool.newRecvMonitor = func() rateMonitor { return monitor }
+
+	pool.SetPeerRange("peer", 1, 10)
+	peer := pool.pickIncrAvailablePeer(1, nil)
+	require.NotNil(t, peer)
+	t.Cleanup(func() { peer.timeout.Stop() })
+	peer.addedAt = time.Now().Add(-defaultRateCheckGracePeriod)
+
+	// the first dip puts the peer on probation and reseeds its rate.
+	monitor.rEMA = 0
+	pool.removeTimedoutPeers()
+	require.Contains(t, pool.peers, peer.id)
+	assert.False(t, peer.probationUntil.IsZero())
+	assert.NotZero(t, monitor.rEMA)
+
+	// it's left alone until the probation ends, by which time it's recovered.
+	pool.removeTimedoutPeers()
+	require.Contains(t, pool.peers, peer.id)
+	monitor.rate = minRecvRate * 2
+	peer.probationUntil = time.Now().Add(-time.Second)
+	pool.removeTimedoutPeers()
+	require.Contains(t, pool.peers, peer.id)
+	assert.True(t, peer.probationUntil.IsZero())
+
+	// another dip gets another probation, but staying slow through it doesn't.
+	monitor.rate = minRecvRate / 10
+	pool.removeTimedoutPeers()
+	require.Contains(t, pool.peers, peer.id)
+	peer.probationUntil = time.Now().Add(-time.Second)
+	pool.removeTimedoutPeers()
+	assert.NotContains(t, pool.peers, peer.id)
+}
+
+func TestBlockPoolInjectBlock(t *testing.T) {
+	requestsCh := make(chan BlockRequest)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10))
+
+	injected := &types.Block{Header: types.Header{Height: 6}}
+	assert.Error(t, pool.InjectBlock(5, injected))
+	require.NoError(t, pool.InjectBlock(6, injected))
+	_, numPending, _ := pool.GetStatus()
+	assert.Zero(t, numPending)
+
+	pool.SetPeerRange("peer", 1, 10)
+	for i := 0; i < 9; i++ {
+		request := <-requestsCh
+		// nothing is requested for the injected height.
+		require.NotEqualValues(t, 6, request.Height)
+		pool.AddBlock("peer", &types.Block{Header: types.Header{Height: request.Height}}, 100)
+	}
+
+	for height := int64(1); height < 10; height++ {
+		first, second, _ := pool.PeekTwoBlocks()
+		require.NotNil(t, first)
+		require.NotNil(t, second)
+		require.Equal(t, height, first.Height)
+		if height == 6 {
+			assert.Same(t, injected, first)
+		}
+		require.NoError(t, pool.PopRequest())
+	}
+	_, numPending, _ = pool.GetStatus()
+	assert.Zero(t, numPending)
+}
+
+func TestBlockPoolInjectBlockBounds(t *testing.T) {
+	pool := newTestPool(t, make(chan BlockRequest), make(chan peerError, 10), WithPrefetchAhead(10))
+
+	assert.Error(t, pool.InjectBlock(5, nil))
+	// the last height makeNextRequester would request.
+	assert.NoError(t, pool.InjectBlock(11, &types.Block{Header: types.Header{Height: 11}}))
+	assert.Error(t, pool.InjectBlock(12, &types.Block{Header: types.Header{Height: 12}}))
+}
+
+func TestBlockPoolRequesterStartFails(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	// requesters can't be started while the pool isn't running.
+	pool.SetPeerRange("peer", 1, 10)
+	assert.False(t, pool.makeNextRequester())
+	_, numPending, lenRequesters := pool.GetStatus()
+	assert.Zero(t, numPending)
+	assert.Zero(t, lenRequesters)
+}
+
+func TestBlockPoolInjectBlockBeforeStart(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	pool, err := NewBlockPool(1, requestsCh, make(chan peerError, 10))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	injected := &types.Block{Header: types.Header{Height: 1}}
+	require.NoError(t, pool.InjectBlock(1, injected))
+	require.NoError(t, pool.Start())
+
+	// only the heights above the injected block are requested.
+	pool.SetPeerRange("peer", 1, 2)
+	request := <-requestsCh
+	assert.EqualValues(t, 2, request.Height)
+	first, _, _ := pool.PeekTwoBlocks()
+	assert.Same(t, injected, first)
+
+	require.NoError(t, pool.Stop())
+	assert.Error(t, pool.InjectBlock(2, &types.Block{Header: types.Header{Height: 2}}))
+}
+
+func TestBlockPoolAutoRemoveSlowPeersDisabled(t *testing.T) {
+	errorsCh := make(chan peerError, 10)
+	pool := newTestPool(t, make(chan BlockRequest), errorsCh, WithAutoRemoveSlowPeers(false))
+
+	pool.SetPeerRange("peer", 1, 10)
+	pool.mtx.Lock()
+	peer := pool.peers["peer"]
+	peer.incrPending()
+	t.Cleanup(func() { peer.timeout.Stop() })
+	peer.addedAt = time.Now().Add(-defaultRateCheckGracePeriod)
+	peer.recvMonitor = &fakeRateMonitor{rate: minRecvRate / 10}
+	pool.mtx.Unlock()
+
+	pool.removeTimedoutPeers()
+
+	// reported and flagged, but still there.
+	peerErr := <-errorsCh
+	assert.Equal(t, PeerErrorTooSlow, peerErr.reason)
+	assert.True(t, pool.hasPeer("peer"))
+	assert.Nil(t, pool.pickIncrAvailablePeer(1, nil))
+	assert.True(t, pool.hasPeer("peer"))
+}
+
+// countingSelector counts the picks it's asked for.
+type countingSelector struct {
+	numCalls int32
+}
+
+func (s *countingSelector) Select(candidates []PeerInfo, height int64) (p2p.ID, bool) {
+	atomic.AddInt32(&s.numCalls, 1)
+	return DefaultSelector{}.Select(candidates, height)
+}
+
+func TestBlockPoolStandbyPeers(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	selector := &countingSelector{}
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10),
+		WithStandbyPeers(true), WithPeerSelector(selector))
+
+	pool.SetPeerRange("a", 1, 1)
+	pool.SetPeerRange("b", 1, 1)
+	primary := <-requestsCh
+	standbyID := p2p.ID("a")
+	if primary.PeerID == "a" {
+		standbyID = "b"
+	}
+
+	// one pick for the primary and one for the standby.
+	pool.mtx.Lock()
+	requester := pool.requesters[1]
+	pool.mtx.Unlock()
+	require.Eventually(t, func() bool {
+		requester.mtx.Lock()
+		defer requester.mtx.Unlock()
+		return requester.standbyPeerID == standbyID
+	}, time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&selector.numCalls))
+	pool.mtx.Lock()
+	assert.EqualValues(t, 1, pool.peers[standbyID].numStandby)
+	assert.Zero(t, pool.peers[standbyID].numPending)
+	pool.mtx.Unlock()
+
+	// the primary fails, and the standby is asked without picking again.
+	pool.RemovePeer(primary.PeerID)
+	request := <-requestsCh
+	assert.Equal(t, BlockRequest{Height: 1, PeerID: standbyID}, request)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&selector.numCalls))
+	pool.mtx.Lock()
+	assert.Zero(t, pool.peers[standbyID].numStandby)
+	assert.EqualValues(t, 1, pool.peers[standbyID].numPending)
+	pool.mtx.Unlock()
+}
+
+func TestBlockPoolPeerStarvationTime(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		workers := workers
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			requestsCh := make(chan BlockRequest, maxTotalRequesters)
+			pool := newTestPool(t, requestsCh, make(chan peerError, 10), WithRequesterWorkers(workers))
+
+			// a single peer can't serve all the heights at once.
+			pool.SetPeerRange("peer", 1, maxPendingRequestsPerPeer+5)
+			for i := 0; i < maxPendingRequestsPerPeer; i++ {
+				<-requestsCh
+			}
+			time.Sleep(200 * time.Millisecond)
+			assert.Zero(t, pool.PeerStarvationTime())
+
+			// the starving requesters get the peer once it's served the others.
+			for height := int64(1); height <= maxPendingRequestsPerPeer; height++ {
+				pool.AddBlock("peer", &types.Block{Header: types.Header{Height: height}}, 100)
+			}
+			for i := 0; i < 5; i++ {
+				<-requestsCh
+			}
+			// each of the 5 requesters starved for at least 200ms.
+			assert.GreaterOrEqual(t, pool.PeerStarvationTime(), time.Second)
+		})
+	}
+}
+
+func TestBlockPoolMaxPeerHeightLead(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError), WithMaxPeerHeightLead(1000))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	// a fresh pool accepts the first peer however far ahead it is.
+	pool.SetPeerRange("a", 1, 1e6)
+	assert.True(t, pool.hasPeer("a"))
+	assert.EqualValues(t, 1e6, pool.MaxPeerHeight())
+
+	pool.SetPeerRange("absurd", 0, math.MaxInt64)
+	assert.False(t, pool.hasPeer("absurd"))
+	pool.SetPeerRange("b", 1, 1e6+1000)
+	assert.True(t, pool.hasPeer("b"))
+	assert.EqualValues(t, 1e6+1000, pool.MaxPeerHeight())
+
+	// an update too far ahead is ignored too.
+	pool.SetPeerRange("a", 1, 1e7)
+	assert.EqualValues(t, 1e6+1000, pool.MaxPeerHeight())
+}
+
+func TestBlockPoolMaxPeerRangeSpan(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError),
+		WithMaxPeerHeightLead(1000), WithMaxPeerRangeSpan(1e6))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+
+	// ignored even though there's no other peer to compare its height with.
+	pool.SetPeerRange("absurd", 0, math.MaxInt64)
+	assert.False(t, pool.hasPeer("absurd"))
+	assert.Zero(t, pool.MaxPeerHeight())
+
+	pool.SetPeerRange("a", 1, 1e6+1)
+	assert.True(t, pool.hasPeer("a"))
+	// within the lead, but too wide.
+	pool.SetPeerRange("wide", 0, 1e6+500)
+	assert.False(t, pool.hasPeer("wide"))
+}
+
+func TestBlockPoolOptions(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError),
+		WithMaxPeers(50, nil), WithHeadPriority(true), WithRequesterWorkers(4))
+	require.NoError(t, err)
+	pool.SetChannelWatchdog(time.Second)
+
+	assert.Equal(t, PoolOptions{
+		// set
+		MaxPeers:         50,
+		HeadPriority:     true,
+		RequesterWorkers: 4,
+		ChannelWatchdog:  time.Second,
+		// defaulted
+		PeerEventLogLevel:      "info",
+		PrefetchAhead:          maxTotalRequesters,
+		ErrorWindow:            defaultErrorWindow,
+		ErrorBurst:             defaultErrorBurst,
+		DebugStringMaxHeights:  defaultDebugStringMaxHeights,
+		RateCheckGracePeriod:   defaultRateCheckGracePeriod,
+		RecvRateSeed:           math.E,
+		AutoRemoveSlowPeers:    true,
+		MaxUnexpectedBlockDiff: defaultMaxDiffBetweenCurrentAndReceivedBlockHeight,
+		CaughtUpChecks:         1,
+		SyncRateHistorySize:    defaultSyncRateHistorySize,
+		DeliveryAuditSize:      defaultDeliveryAuditSize,
+		HeightDecreasePolicy:   HeightDecreaseAccept,
+	}, pool.Options())
+}
+
+func TestBlockPoolSamePeerRetries(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10),
+		WithRequesterWorkers(1), WithSamePeerRetries(2, 10*time.Millisecond))
+
+	pool.SetPeerRange("peer", 1, 1)
+	request := <-requestsCh
+	require.Equal(t, BlockRequest{Height: 1, PeerID: "peer"}, request)
+	pool.mtx.Lock()
+	requester := pool.requesters[1]
+	pool.mtx.Unlock()
+
+	// the first two timeouts ask the same peer again, without a redo.
+	for i := 0; i < 2; i++ {
+		pool.retryRequester(requester, "peer")
+		request = <-requestsCh
+		assert.Equal(t, BlockRequest{Height: 1, PeerID: "peer"}, request)
+		requester.mtx.Lock()
+		assert.Zero(t, requester.numRedos)
+		requester.mtx.Unlock()
+	}
+
+	// the third one gives up on the request and redoes it.
+	pool.retryRequester(requester, "peer")
+	request = <-requestsCh
+	assert.Equal(t, BlockRequest{Height: 1, PeerID: "peer"}, request)
+	requester.mtx.Lock()
+	assert.EqualValues(t, 1, requester.numRedos)
+	requester.mtx.Unlock()
+
+	pool.AddBlock("peer", &types.Block{Header: types.Header{Height: 1}}, 100)
+	requester.mtx.Lock()
+	assert.Zero(t, requester.numSamePeerRetries)
+	requester.mtx.Unlock()
+}
+
+func TestBlockPoolBlockSizeStats(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10))
+
+	min, max, avg := pool.BlockSizeStats()
+	assert.Zero(t, min)
+	assert.Zero(t, max)
+	assert.Zero(t, avg)
+
+	sizes := map[int64]int{1: 300, 2: 100, 3: 500, 4: 200, 5: 400}
+	pool.SetPeerRange("peer", 1, 5)
+	for i := 0; i < len(sizes); i++ {
+		request := <-requestsCh
+		pool.AddBlock("peer", &types.Block{Header: types.Header{Height: request.Height}}, sizes[request.Height])
+	}
+	min, max, avg = pool.BlockSizeStats()
+	assert.Equal(t, 100, min)
+	assert.Equal(t, 500, max)
+	assert.Equal(t, 300, avg)
+
+	// only the last blockSizeSamples sizes count.
+	pool.mtx.Lock()
+	for i := 0; i < blockSizeSamples; i++ {
+		pool.sampleBlockSize(1000 + i%2)
+	}
+	pool.mtx.Unlock()
+	min, max, avg = pool.BlockSizeStats()
+	assert.Equal(t, 1000, min)
+	assert.Equal(t, 1001, max)
+	assert.Equal(t, 1000, avg)
+}
+
+func TestBlockPoolSamePeerRetryLateReply(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+	pool := newTestPool(t, requestsCh, errorsCh,
+		WithRequesterWorkers(1), WithSamePeerRetries(2, 10*time.Millisecond))
+
+	pool.SetPeerRange("peer", 1, 1)
+	<-requestsCh
+	pool.mtx.Lock()
+	requester := pool.requesters[1]
+	pool.mtx.Unlock()
+	pool.retryRequester(requester, "peer")
+	<-requestsCh
+
+	// the retry is answered first, then the original request.
+	pool.AddBlock("peer", &types.Block{Header: types.Header{Height: 1}}, 100)
+	pool.AddBlock("peer", &types.Block{Header: types.Header{Height: 1}}, 100)
+	assert.Empty(t, errorsCh)
+	pool.mtx.Lock()
+	assert.Zero(t, pool.peers["peer"].numDuplicateBlocks)
+	pool.mtx.Unlock()
+
+	// anything beyond that is a duplicate.
+	pool.AddBlock("peer", &types.Block{Header: types.Header{Height: 1}}, 100)
+	peerErr := <-errorsCh
+	assert.Equal(t, PeerErrorDuplicate, peerErr.reason)
+}
+
+func TestBlockPoolLateReplyAfterRedo(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	errorsCh := make(chan peerError, 10)
+	pool := newTestPool(t, requestsCh, errorsCh,
+		WithRequesterWorkers(1), WithPeerSelector(lastPeerSelector{}))
+
+	pool.SetPeerRange("a", 1, 1)
+	first := <-requestsCh
+	pool.SetPeerRange("b", 1, 1)
+	pool.mtx.Lock()
+	requester := pool.requesters[1]
+	pool.mtx.Unlock()
+	pool.retryRequester(requester, first.PeerID)
+	second := <-requestsCh
+	require.NotEqual(t, first.PeerID, second.PeerID)
+
+	// the first peer answers after the timeout, both before and after the
+	// second one does.
+	pool.AddBlock(first.PeerID, &types.Block{Header: types.Header{Height: 1}}, 100)
+	assert.Nil(t, requester.getBlock())
+	pool.AddBlock(second.PeerID, &types.Block{Header: types.Header{Height: 1}}, 100)
+	assert.NotNil(t, requester.getBlock())
+	pool.AddBlock(first.PeerID, &types.Block{Header: types.Header{Height: 1}}, 100)
+	assert.Empty(t, errorsCh)
+}
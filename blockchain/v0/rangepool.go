@@ -0,0 +1,191 @@
+package v0
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/libs/service"
+	"github.com/tendermint/tendermint/p2p"
+	"github.com/tendermint/tendermint/types"
+)
+
+// RangePool syncs consecutive, disjoint height ranges in parallel, each with
+// its own BlockPool, and delivers the blocks of all ranges in order on a single
+// channel. It's meant for backfilling a long stretch of the chain faster than
+// a single BlockPool would.
+//
+// Like BlockPool, it sends block requests and peer errors to the given
+// channels; the blocks received in response must be passed to AddBlock.
+//
+// NOTE: the blocks are not verified. The consumer must verify every block with
+// the LastCommit of the next one, as the reactor does. Consequently,
+// WithCommitVerifier must not be passed to NewRangePool: the last block of a
+// range can't be verified without the first block of the next range.
+type RangePool struct {
+	service.BaseService
+
+	// pools[i] syncs the heights [bounds[i], bounds[i+1]).
+	pools  []*BlockPool
+	bounds []int64
+
+	blocksCh chan *types.Block
+
+	// closed at the start of OnStop, which then waits for deliverRoutine
+	stopCh      chan struct{}
+	deliverDone sync.WaitGroup
+}
+
+// NewRangePool returns a new RangePool syncing the heights [bounds[0],
+// bounds[len(bounds)-1]), split into len(bounds)-1 ranges at the given bounds.
+// The options are applied to every range's BlockPool. It returns an error if
+// there are fewer than two bounds or they're not increasing from a positive
+// height.
+func NewRangePool(
+	bounds []int64,
+	requestsCh chan<- BlockRequest,
+	errorsCh chan<- peerError,
+	options ...BlockPoolOption,
+) (*RangePool, error) {
+	if len(bounds) < 2 {
+		return nil, fmt.Errorf("need at least 2 bounds, got %d", len(bounds))
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return nil, fmt.Errorf("bounds must be increasing, got %d after %d", bounds[i], bounds[i-1])
+		}
+	}
+
+	rp := &RangePool{
+		pools:    make([]*BlockPool, 0, len(bounds)-1),
+		bounds:   bounds,
+		blocksCh: make(chan *types.Block, maxTotalRequesters),
+		stopCh:   make(chan struct{}),
+	}
+	for i := 0; i < len(bounds)-1; i++ {
+		opts := append([]BlockPoolOption{WithEndHeight(bounds[i+1])}, options...)
+		pool, err := NewBlockPool(bounds[i], requestsCh, errorsCh, opts...)
+		if err != nil {
+			return nil, err
+		}
+		rp.pools = append(rp.pools, pool)
+	}
+	rp.BaseService = *service.NewBaseService(nil, "RangePool", rp)
+	return rp, nil
+}
+
+// SetLogger implements service.Service by setting the logger on the range pool
+// and every range's BlockPool.
+func (rp *RangePool) SetLogger(l log.Logger) {
+	rp.BaseService.Logger = l
+	for i, pool := range rp.pools {
+		pool.SetLogger(l.With("range", fmt.Sprintf("[%d, %d)", rp.bounds[i], rp.bounds[i+1])))
+	}
+}
+
+// OnStart implements service.Service by starting every range's BlockPool and
+// the routine delivering the blocks.
+func (rp *RangePool) OnStart() error {
+	for _, pool := range rp.pools {
+		if err := pool.Start(); err != nil {
+			return err
+		}
+	}
+	rp.deliverDone.Add(1)
+	go func() {
+		defer rp.deliverDone.Done()
+		rp.deliverRoutine()
+	}()
+	return nil
+}
+
+// OnStop implements service.Service by stopping the routine delivering the
+// blocks and the BlockPools which are still running.
+func (rp *RangePool) OnStop() {
+	close(rp.stopCh)
+	rp.deliverDone.Wait()
+
+	for _, pool := range rp.pools {
+		if err := pool.Stop(); err != nil && err != service.ErrAlreadyStopped {
+			rp.Logger.Error("Error stopping pool", "err", err)
+		}
+	}
+}
+
+// Blocks returns the channel the blocks are delivered on, in order. It's closed
+// once the blocks of all ranges have been delivered, or earlier if the range
+// pool is stopped or fails to pop a block.
+func (rp *RangePool) Blocks() <-chan *types.Block {
+	return rp.blocksCh
+}
+
+// SetPeerRange sets the peer's alleged blockchain base and height on every
+// range's BlockPool.
+func (rp *RangePool) SetPeerRange(peerID p2p.ID, base int64, height int64) {
+	for _, pool := range rp.pools {
+		pool.SetPeerRange(peerID, base, height)
+	}
+}
+
+// RemovePeer removes the peer from every range's BlockPool.
+func (rp *RangePool) RemovePeer(peerID p2p.ID) {
+	for _, pool := range rp.pools {
+		pool.RemovePeer(peerID)
+	}
+}
+
+// AddBlock passes the block to the BlockPool of the range it belongs to. Blocks
+// outside of all ranges are passed to the first or last one, which handles
+// them as unexpected.
+func (rp *RangePool) AddBlock(peerID p2p.ID, block *types.Block, blockSize int) {
+	rp.poolFor(block.Height).AddBlock(peerID, block, blockSize)
+}
+
+// Returns the BlockPool of the range the height belongs to or, if the height
+// is outside of all ranges, the closest one.
+func (rp *RangePool) poolFor(height int64) *BlockPool {
+	for i, pool := range rp.pools {
+		if height < rp.bounds[i+1] {
+			return pool
+		}
+	}
+	return rp.pools[len(rp.pools)-1]
+}
+
+// Pops the blocks of every range in order and sends them to blocksCh. The
+// BlockPool of a range is stopped once all of its blocks have been delivered.
+// blocksCh is closed when it returns.
+func (rp *RangePool) deliverRoutine() {
+	defer close(rp.blocksCh)
+
+	for i, pool := range rp.pools {
+		for height := rp.bounds[i]; height < rp.bounds[i+1]; height++ {
+			var block *types.Block
+			for {
+				if block, _, _ = pool.PeekTwoBlocks(); block != nil {
+					break
+				}
+				select {
+				case <-rp.stopCh:
+					return
+				case <-time.After(requestIntervalMS * time.Millisecond):
+				}
+			}
+			if err := pool.PopRequest(); err != nil {
+				rp.Logger.Error("Error popping block", "height", height, "err", err)
+				return
+			}
+
+			select {
+			case rp.blocksCh <- block:
+			case <-rp.stopCh:
+				return
+			}
+		}
+
+		if err := pool.Stop(); err != nil {
+			rp.Logger.Error("Error stopping pool", "err", err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package v0
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestNewRangePoolInvalidBounds(t *testing.T) {
+	for _, bounds := range [][]int64{nil, {1}, {1, 1}, {5, 3}, {0, 3}} {
+		_, err := NewRangePool(bounds, make(chan BlockRequest), make(chan peerError))
+		assert.Error(t, err, "bounds %v", bounds)
+	}
+}
+
+func TestRangePoolDeliversInOrder(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 100)
+	errorsCh := make(chan peerError, 100)
+
+	rp, err := NewRangePool([]int64{1, 4, 7}, requestsCh, errorsCh)
+	require.NoError(t, err)
+	rp.SetLogger(log.TestingLogger())
+	err = rp.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := rp.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	requested := make(chan int64, 100)
+	go func() {
+		for request := range requestsCh {
+			requested <- request.Height
+			block := &types.Block{Header: types.Header{Height: request.Height}}
+			rp.AddBlock(request.PeerID, block, 123)
+		}
+	}()
+	rp.SetPeerRange("peer", 1, 10)
+
+	var heights []int64
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case block, ok := <-rp.Blocks():
+			if !ok {
+				done = true
+				break
+			}
+			heights = append(heights, block.Height)
+		case <-timeout:
+			t.Fatalf("timed out, got blocks %v", heights)
+		}
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4, 5, 6}, heights)
+
+	for len(requested) > 0 {
+		assert.Less(t, <-requested, int64(7), "requested a block outside of the ranges")
+	}
+	assert.Empty(t, errorsCh)
+}
+
+func TestRangePoolStopClosesBlocks(t *testing.T) {
+	rp, err := NewRangePool([]int64{1, 4, 7}, make(chan BlockRequest, 100), make(chan peerError, 100))
+	require.NoError(t, err)
+	rp.SetLogger(log.TestingLogger())
+	require.NoError(t, rp.Start())
+
+	// no peers, so no block is ever delivered.
+	require.NoError(t, rp.Stop())
+	select {
+	case _, ok := <-rp.Blocks():
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("blocks channel not closed")
+	}
+}
@@ -38,13 +38,53 @@ type consensusReactor interface {
 	SwitchToConsensus(state sm.State, skipWAL bool)
 }
 
+// PeerErrorReason tells why a peer is reported by the BlockPool, so that
+// different penalties may be applied.
+type PeerErrorReason int
+
+const (
+	PeerErrorUnknown       PeerErrorReason = iota // no reason given
+	PeerErrorTooSlow                              // sends blocks slower than minRecvRate
+	PeerErrorNoResponse                           // doesn't send the blocks it's asked for
+	PeerErrorBadBlock                             // sent a block which failed verification
+	PeerErrorBlockMismatch                        // sent a block it wasn't asked for or which conflicts with another peer's
+	PeerErrorOversized                            // sent a block bigger than allowed
+	PeerErrorDuplicate                            // sent a block we already have
+	PeerErrorBadStatus                            // reported an inconsistent range
+	PeerErrorOutOfOrder                           // sent a block far below the ones it sent before
+)
+
+func (r PeerErrorReason) String() string {
+	switch r {
+	case PeerErrorTooSlow:
+		return "too slow"
+	case PeerErrorNoResponse:
+		return "no response"
+	case PeerErrorBadBlock:
+		return "bad block"
+	case PeerErrorBlockMismatch:
+		return "block mismatch"
+	case PeerErrorOversized:
+		return "oversized block"
+	case PeerErrorDuplicate:
+		return "duplicate block"
+	case PeerErrorBadStatus:
+		return "bad status"
+	case PeerErrorOutOfOrder:
+		return "out of order block"
+	default:
+		return "unknown"
+	}
+}
+
 type peerError struct {
 	err    error
 	peerID p2p.ID
+	reason PeerErrorReason
 }
 
 func (e peerError) Error() string {
-	return fmt.Sprintf("error with peer %v: %s", e.peerID, e.err.Error())
+	return fmt.Sprintf("error with peer %v (%v): %s", e.peerID, e.reason, e.err.Error())
 }
 
 // BlockchainReactor handles long-term catchup syncing.
@@ -81,7 +121,10 @@ func NewBlockchainReactor(state sm.State, blockExec *sm.BlockExecutor, store *st
 	if startHeight == 1 {
 		startHeight = state.InitialHeight
 	}
-	pool := NewBlockPool(startHeight, requestsCh, errorsCh)
+	pool, err := NewBlockPool(startHeight, requestsCh, errorsCh)
+	if err != nil {
+		panic(err)
+	}
 
 	bcR := &BlockchainReactor{
 		initialState: state,
@@ -99,7 +142,7 @@ func NewBlockchainReactor(state sm.State, blockExec *sm.BlockExecutor, store *st
 // SetLogger implements service.Service by setting the logger on reactor and pool.
 func (bcR *BlockchainReactor) SetLogger(l log.Logger) {
 	bcR.BaseService.Logger = l
-	bcR.pool.Logger = l
+	bcR.pool.SetLogger(l)
 }
 
 // OnStart implements service.Service.
@@ -268,9 +311,6 @@ func (bcR *BlockchainReactor) poolRoutine(stateSynced bool) {
 	chainID := bcR.initialState.ChainID
 	state := bcR.initialState
 
-	lastHundred := time.Now()
-	lastRate := 0.0
-
 	didProcessCh := make(chan struct{}, 1)
 
 	go func() {
@@ -346,7 +386,7 @@ FOR_LOOP:
 			// routine.
 
 			// See if there are any blocks to sync.
-			first, second := bcR.pool.PeekTwoBlocks()
+			first, second, _ := bcR.pool.PeekTwoBlocks()
 			// bcR.Logger.Info("TrySync peeked", "first", first, "second", second)
 			if first == nil || second == nil {
 				// We need both to sync the first block.
@@ -390,7 +430,10 @@ FOR_LOOP:
 				continue FOR_LOOP
 			}
 
-			bcR.pool.PopRequest()
+			if err := bcR.pool.PopRequest(); err != nil {
+				bcR.Logger.Error("Error popping block", "err", err)
+				continue FOR_LOOP
+			}
 
 			// TODO: batch saves so we dont persist to disk every block
 			bcR.store.SaveBlock(first, firstParts, second.LastCommit)
@@ -404,11 +447,9 @@ FOR_LOOP:
 			}
 			blocksSynced++
 
-			if blocksSynced%100 == 0 {
-				lastRate = 0.9*lastRate + 0.1*(100/time.Since(lastHundred).Seconds())
+			if blocksSynced%syncRateWindow == 0 {
 				bcR.Logger.Info("Fast Sync Rate", "height", bcR.pool.height,
-					"max_peer_height", bcR.pool.MaxPeerHeight(), "blocks/s", lastRate)
-				lastHundred = time.Now()
+					"max_peer_height", bcR.pool.MaxPeerHeight(), "blocks/s", bcR.pool.SyncRate())
 			}
 
 			continue FOR_LOOP
@@ -0,0 +1,48 @@
+package v0
+
+import (
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// PeerInfo is a snapshot of a peer's state, as seen by the BlockPool.
+type PeerInfo struct {
+	ID     p2p.ID
+	Base   int64
+	Height int64
+	// number of requests sent to the peer which haven't been served yet
+	NumPending int32
+	// current receive rate in bytes per second or 0 if unknown
+	CurRate int64
+}
+
+// Returns true if the peer is likely to deliver a block sooner than other:
+// it has fewer requests pending or, if equal, receives data faster.
+func (pi PeerInfo) isBetterThan(other PeerInfo) bool {
+	if pi.NumPending != other.NumPending {
+		return pi.NumPending < other.NumPending
+	}
+	return pi.CurRate > other.CurRate
+}
+
+// PeerSelector picks a peer to request a block from.
+type PeerSelector interface {
+	// Select returns the ID of the candidate to request the block at height
+	// from or false if none should be picked for now, in which case the pool
+	// retries shortly. candidates is never empty and contains only the peers
+	// which may serve the height. For the heights the pool is waiting on, the
+	// candidates are sorted best first.
+	//
+	// Select is called concurrently and without holding the pool's lock, so
+	// the chosen peer is re-checked afterwards.
+	Select(candidates []PeerInfo, height int64) (p2p.ID, bool)
+}
+
+// DefaultSelector picks the first candidate.
+type DefaultSelector struct{}
+
+var _ PeerSelector = DefaultSelector{}
+
+// Select implements PeerSelector.
+func (DefaultSelector) Select(candidates []PeerInfo, height int64) (p2p.ID, bool) {
+	return candidates[0].ID, true
+}
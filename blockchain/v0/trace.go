@@ -0,0 +1,126 @@
+package v0
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// HeightEventType is a step in the lifecycle of a height, see TraceHeight.
+type HeightEventType int
+
+const (
+	HeightRequested     HeightEventType = iota // a requester was made for the height
+	HeightPeerAssigned                         // the block was requested from PeerID
+	HeightRedone                               // the request to PeerID was dropped, to be retried
+	HeightBlockReceived                        // PeerID delivered the block, or it was injected
+	HeightValidated                            // the block passed verification and is about to be popped
+	HeightPopped                               // the block was popped
+)
+
+func (t HeightEventType) String() string {
+	switch t {
+	case HeightRequested:
+		return "requested"
+	case HeightPeerAssigned:
+		return "peer assigned"
+	case HeightRedone:
+		return "redone"
+	case HeightBlockReceived:
+		return "block received"
+	case HeightValidated:
+		return "validated"
+	case HeightPopped:
+		return "popped"
+	default:
+		return "unknown"
+	}
+}
+
+// HeightEvent is sent by TraceHeight.
+type HeightEvent struct {
+	Type   HeightEventType
+	Height int64
+	PeerID p2p.ID // empty if the event doesn't involve a peer
+	Time   time.Time
+}
+
+// Number of events buffered per TraceHeight channel. Events which don't fit
+// are dropped rather than blocking the pool.
+const heightTraceBufferSize = 32
+
+// TraceHeight returns a channel on which the lifecycle events of the given
+// height are sent from now on, e.g. to debug a height which keeps being
+// redone. The channel is closed once the height is popped or skipped, or the
+// pool is stopped, or right away if either already happened. Events are
+// dropped if the channel isn't drained.
+func (pool *BlockPool) TraceHeight(height int64) <-chan HeightEvent {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	ch := make(chan HeightEvent, heightTraceBufferSize)
+	if height < pool.height {
+		close(ch)
+		return ch
+	}
+
+	pool.tracesMtx.Lock()
+	defer pool.tracesMtx.Unlock()
+	if pool.tracesClosed {
+		close(ch)
+		return ch
+	}
+	if pool.traces == nil {
+		pool.traces = make(map[int64][]chan HeightEvent)
+	}
+	pool.traces[height] = append(pool.traces[height], ch)
+	atomic.AddInt32(&pool.numTraces, 1)
+	return ch
+}
+
+// Sends the event to the height's traces, if any.
+func (pool *BlockPool) traceHeight(eventType HeightEventType, height int64, peerID p2p.ID) {
+	if atomic.LoadInt32(&pool.numTraces) == 0 {
+		return
+	}
+
+	pool.tracesMtx.Lock()
+	defer pool.tracesMtx.Unlock()
+	event := HeightEvent{Type: eventType, Height: height, PeerID: peerID, Time: time.Now()}
+	for _, ch := range pool.traces[height] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Closes the height's traces, if any.
+func (pool *BlockPool) closeTraces(height int64) {
+	if atomic.LoadInt32(&pool.numTraces) == 0 {
+		return
+	}
+
+	pool.tracesMtx.Lock()
+	defer pool.tracesMtx.Unlock()
+	for _, ch := range pool.traces[height] {
+		close(ch)
+	}
+	atomic.AddInt32(&pool.numTraces, -int32(len(pool.traces[height])))
+	delete(pool.traces, height)
+}
+
+// Closes the traces of all heights, and the ones added later.
+func (pool *BlockPool) closeAllTraces() {
+	pool.tracesMtx.Lock()
+	defer pool.tracesMtx.Unlock()
+	pool.tracesClosed = true
+	for height, chs := range pool.traces {
+		for _, ch := range chs {
+			close(ch)
+		}
+		atomic.AddInt32(&pool.numTraces, -int32(len(chs)))
+		delete(pool.traces, height)
+	}
+}
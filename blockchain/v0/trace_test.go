@@ -0,0 +1,86 @@
+package v0
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestBlockPoolTraceHeight(t *testing.T) {
+	requestsCh := make(chan BlockRequest, 10)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10))
+
+	events := pool.TraceHeight(1)
+	pool.SetPeerRange("a", 1, 2)
+	pool.SetPeerRange("b", 1, 2)
+
+	// collect the first requests, then redo height 1.
+	requested := make(map[int64]p2p.ID)
+	for len(requested) < 2 {
+		request := <-requestsCh
+		requested[request.Height] = request.PeerID
+	}
+	first := requested[1]
+	pool.RedoRequest(1)
+	for {
+		request := <-requestsCh
+		requested[request.Height] = request.PeerID
+		if request.Height == 1 {
+			break
+		}
+	}
+	second := requested[1]
+	require.NotEqual(t, first, second)
+
+	// height 2 doesn't matter, popping doesn't wait for it.
+	pool.AddBlock(second, &types.Block{Header: types.Header{Height: 1}}, 100)
+	require.NoError(t, pool.PopRequest())
+
+	var got []HeightEvent
+	for event := range events {
+		assert.EqualValues(t, 1, event.Height)
+		got = append(got, event)
+	}
+	var eventTypes []HeightEventType
+	for _, event := range got {
+		eventTypes = append(eventTypes, event.Type)
+	}
+	assert.Equal(t, []HeightEventType{
+		HeightRequested,
+		HeightPeerAssigned,
+		HeightRedone,
+		HeightPeerAssigned,
+		HeightBlockReceived,
+		HeightValidated,
+		HeightPopped,
+	}, eventTypes)
+	assert.Equal(t, first, got[1].PeerID)
+	assert.Equal(t, first, got[2].PeerID)
+	assert.Equal(t, second, got[3].PeerID)
+	assert.Equal(t, second, got[4].PeerID)
+
+	// popped already.
+	_, ok := <-pool.TraceHeight(1)
+	assert.False(t, ok)
+}
+
+func TestBlockPoolTraceHeightClosedOnStop(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest, 10), make(chan peerError, 10))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	err = pool.Start()
+	require.NoError(t, err)
+
+	// height 100 is never reached.
+	events := pool.TraceHeight(100)
+	require.NoError(t, pool.Stop())
+	for range events {
+	}
+	_, ok := <-pool.TraceHeight(100)
+	assert.False(t, ok)
+}
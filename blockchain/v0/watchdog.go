@@ -0,0 +1,74 @@
+package v0
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SetChannelWatchdog makes the pool check every interval whether its sends on
+// requestsCh and errorsCh block, i.e. whether the reactor is slow to consume
+// them, and log an error if they've blocked for longer than interval. Such a
+// reactor otherwise shows up only as a sync stall. It must be called before the
+// pool is started. 0 disables the watchdog, which is the default.
+func (pool *BlockPool) SetChannelWatchdog(interval time.Duration) {
+	pool.watchdogInterval = interval
+}
+
+func (pool *BlockPool) channelWatchdog() {
+	ticker := time.NewTicker(pool.watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pool.stopCh:
+			return
+		case <-ticker.C:
+			pool.checkChannels()
+		}
+	}
+}
+
+// Logs and returns true if a send has been blocked, or took, longer than the
+// watchdog interval since the last check.
+func (pool *BlockPool) checkChannels() bool {
+	maxLatency := time.Duration(atomic.SwapInt64(&pool.maxSendLatency, 0))
+	numBlocked := atomic.LoadInt32(&pool.numBlockedSends)
+	var blockedFor time.Duration
+	if numBlocked > 0 {
+		blockedFor = time.Since(time.Unix(0, atomic.LoadInt64(&pool.sendsBlockedSince)))
+	}
+	if maxLatency < pool.watchdogInterval && blockedFor < pool.watchdogInterval {
+		return false
+	}
+
+	pool.Logger.Error("Reactor is slow to consume block requests and peer errors",
+		"maxSendLatency", maxLatency, "blockedSends", numBlocked, "blockedFor", blockedFor)
+	return true
+}
+
+// Marks the start of a send on requestsCh or errorsCh. The returned time must
+// be passed to endSend once it's done.
+func (pool *BlockPool) beginSend() time.Time {
+	if pool.watchdogInterval <= 0 {
+		return time.Time{}
+	}
+	now := time.Now()
+	if atomic.AddInt32(&pool.numBlockedSends, 1) == 1 {
+		atomic.StoreInt64(&pool.sendsBlockedSince, now.UnixNano())
+	}
+	return now
+}
+
+func (pool *BlockPool) endSend(start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	atomic.AddInt32(&pool.numBlockedSends, -1)
+	latency := int64(time.Since(start))
+	for {
+		max := atomic.LoadInt64(&pool.maxSendLatency)
+		if latency <= max || atomic.CompareAndSwapInt64(&pool.maxSendLatency, max, latency) {
+			return
+		}
+	}
+}
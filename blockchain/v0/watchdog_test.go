@@ -0,0 +1,55 @@
+package v0
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/libs/log"
+)
+
+func TestBlockPoolChannelWatchdog(t *testing.T) {
+	requestsCh := make(chan BlockRequest)
+	pool, err := NewBlockPool(1, requestsCh, make(chan peerError, 10))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	pool.SetChannelWatchdog(20 * time.Millisecond)
+	err = pool.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := pool.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// nobody consumes the requests yet.
+	pool.SetPeerRange("peer", 1, 10)
+	assert.Eventually(t, pool.checkChannels, time.Second, 10*time.Millisecond)
+
+	go func() {
+		for {
+			select {
+			case <-requestsCh:
+			case <-pool.Quit():
+				return
+			}
+		}
+	}()
+	assert.Eventually(t, func() bool { return !pool.checkChannels() }, time.Second, 10*time.Millisecond)
+}
+
+func TestBlockPoolChannelWatchdogShutdown(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError),
+		WithShutdownTimeout(time.Second))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	pool.SetChannelWatchdog(time.Hour)
+	require.NoError(t, pool.Start())
+
+	start := time.Now()
+	require.NoError(t, pool.Stop())
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Empty(t, pool.aliveRoutines())
+}
@@ -0,0 +1,214 @@
+package v0
+
+import (
+	"sync/atomic"
+	"time"
+
+	tmsync "github.com/tendermint/tendermint/libs/sync"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+/*
+	Requester workers (see WithRequesterWorkers) do the job of
+	bpRequester.requestRoutine for all requesters. A requester which needs a
+	peer is pushed to the requesterQueue. A worker pops it, picks a peer, sends
+	the request and arms a timer to retry it. Redos reset the requester and push
+	it back to the queue. If no peer is available, the requester is parked and
+	pushed back a bit later. Nothing else happens until the block arrives, so no
+	goroutine is needed meanwhile.
+
+	A requester is in the queue or served by a worker only while it has no peer
+	assigned, and only the one who resets it pushes it back, so no two workers
+	serve the same requester.
+*/
+
+// requesterQueue is an unbounded FIFO queue of the requesters which need a
+// peer. Requesters for which no peer was available are parked, and put back to
+// the queue periodically.
+type requesterQueue struct {
+	mtx        tmsync.Mutex
+	requesters []*bpRequester
+	parked     []*bpRequester
+	// signaled when a requester is pushed
+	readyCh chan struct{}
+}
+
+func newRequesterQueue() *requesterQueue {
+	return &requesterQueue{
+		readyCh: make(chan struct{}, 1),
+	}
+}
+
+func (q *requesterQueue) push(bpr *bpRequester) {
+	q.mtx.Lock()
+	q.requesters = append(q.requesters, bpr)
+	q.mtx.Unlock()
+
+	q.signal()
+}
+
+func (q *requesterQueue) park(bpr *bpRequester) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.parked = append(q.parked, bpr)
+}
+
+// Puts the parked requesters back to the queue.
+func (q *requesterQueue) unpark() {
+	q.mtx.Lock()
+	if len(q.parked) == 0 {
+		q.mtx.Unlock()
+		return
+	}
+	q.requesters = append(q.requesters, q.parked...)
+	q.parked = nil
+	q.mtx.Unlock()
+
+	q.signal()
+}
+
+// Returns false if the queue is empty. Signals the other workers if it's not
+// empty afterwards.
+func (q *requesterQueue) pop() (*bpRequester, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if len(q.requesters) == 0 {
+		return nil, false
+	}
+	bpr := q.requesters[0]
+	q.requesters[0] = nil
+	q.requesters = q.requesters[1:]
+	if len(q.requesters) > 0 {
+		q.signal()
+	}
+	return bpr, true
+}
+
+func (q *requesterQueue) signal() {
+	select {
+	case q.readyCh <- struct{}{}:
+	default:
+	}
+}
+
+// Serves the requesters in the queue until the pool stops.
+func (pool *BlockPool) requesterWorker() {
+	ticker := time.NewTicker(requestIntervalMS * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		bpr, ok := pool.requesterQueue.pop()
+		if !ok {
+			select {
+			case <-pool.stopCh:
+				return
+			case <-pool.requesterQueue.readyCh:
+			case <-ticker.C:
+				pool.requesterQueue.unpark()
+			}
+			continue
+		}
+		pool.serveRequester(bpr)
+	}
+}
+
+// Picks a peer for the requester and sends the request, or parks the requester
+// if there's no peer available.
+func (pool *BlockPool) serveRequester(bpr *bpRequester) {
+	if !bpr.IsRunning() || !pool.IsRunning() {
+		return
+	}
+
+	peer := pool.pickIncrRequesterPeer(bpr)
+	if peer == nil {
+		bpr.mtx.Lock()
+		if bpr.starvedSince.IsZero() {
+			bpr.starvedSince = time.Now()
+		}
+		bpr.mtx.Unlock()
+		pool.requesterQueue.park(bpr)
+		return
+	}
+
+	bpr.mtx.Lock()
+	if !bpr.starvedSince.IsZero() {
+		atomic.AddInt64(&pool.starvationTime, int64(time.Since(bpr.starvedSince)))
+		bpr.starvedSince = time.Time{}
+	}
+	prevPeerID := bpr.lastPeerID
+	bpr.peerID = peer.id
+	bpr.lastPeerID = peer.id
+	bpr.mtx.Unlock()
+	pool.traceHeight(HeightPeerAssigned, bpr.height, peer.id)
+
+	if prevPeerID != "" && prevPeerID != peer.id && pool.onRequesterReassigned != nil {
+		pool.onRequesterReassigned(bpr.height, prevPeerID, peer.id)
+	}
+
+	// The peer could have been removed before we've set peerID, in which
+	// case no redo was sent our way.
+	if !pool.hasPeer(peer.id) {
+		if bpr.resetIfAssigned(peer.id, false) {
+			pool.requesterQueue.push(bpr)
+		}
+		return
+	}
+
+	timeout := pool.requestRetryTimeout(bpr.height)
+	bpr.mtx.Lock()
+	if bpr.peerID != peer.id {
+		// redone in the meantime, and pushed back to the queue.
+		bpr.mtx.Unlock()
+		return
+	}
+	bpr.requestedAt = time.Now()
+	bpr.retryTimer = time.AfterFunc(timeout, func() { pool.retryRequester(bpr, peer.id) })
+	bpr.mtx.Unlock()
+
+	pool.sendRequest(bpr.height, peer.id)
+	pool.pickStandbyPeer(bpr, peer.id)
+}
+
+// Called when the block wasn't received from peerID in time. Requests it again,
+// unless it has arrived or was requested from another peer in the meantime.
+func (pool *BlockPool) retryRequester(bpr *bpRequester, peerID p2p.ID) {
+	if !bpr.IsRunning() || !pool.IsRunning() {
+		return
+	}
+	if bpr.getBlock() == nil && bpr.getPeerID() == peerID && bpr.takeSamePeerRetry() {
+		bpr.Logger.Debug("Retrying block request with the same peer", "height", bpr.height, "peer", peerID)
+		pool.recordRequestTimeout(peerID)
+		bpr.mtx.Lock()
+		bpr.retryTimer = time.AfterFunc(pool.samePeerRetryDelay, func() { pool.resendRequest(bpr, peerID) })
+		bpr.mtx.Unlock()
+		return
+	}
+	if !bpr.resetIfAssigned(peerID, true) {
+		return
+	}
+	bpr.Logger.Debug("Retrying block request after timeout", "height", bpr.height, "peer", peerID)
+	pool.recordRequestTimeout(peerID)
+	pool.requesterQueue.push(bpr)
+}
+
+// Requests the block again from the peer the requester is assigned to, unless
+// it's been redone in the meantime. See WithSamePeerRetries.
+func (pool *BlockPool) resendRequest(bpr *bpRequester, peerID p2p.ID) {
+	if !bpr.IsRunning() || !pool.IsRunning() {
+		return
+	}
+
+	timeout := pool.requestRetryTimeout(bpr.height)
+	bpr.mtx.Lock()
+	if bpr.peerID != peerID || bpr.block != nil {
+		bpr.mtx.Unlock()
+		return
+	}
+	bpr.requestedAt = time.Now()
+	bpr.retryTimer = time.AfterFunc(timeout, func() { pool.retryRequester(bpr, peerID) })
+	bpr.mtx.Unlock()
+
+	pool.sendRequest(bpr.height, peerID)
+}
@@ -0,0 +1,123 @@
+package v0
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestBlockPoolRequesterWorkers(t *testing.T) {
+	requestsCh := make(chan BlockRequest, maxTotalRequesters)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 100), WithRequesterWorkers(2))
+
+	pool.SetPeerRange("a", 1, 50)
+	pool.SetPeerRange("b", 1, 50)
+
+	timeout := time.After(10 * time.Second)
+	for {
+		if height, _, _ := pool.GetStatus(); height == 50 {
+			break
+		}
+		select {
+		case request := <-requestsCh:
+			block := &types.Block{Header: types.Header{Height: request.Height}}
+			pool.AddBlock(request.PeerID, block, 123)
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out syncing with requester workers")
+		}
+		if first, second, _ := pool.PeekTwoBlocks(); first != nil && second != nil {
+			require.NoError(t, pool.PopRequest())
+		}
+	}
+}
+
+func TestBlockPoolRequesterWorkersReassign(t *testing.T) {
+	reassigned := make(chan p2p.ID, 10)
+	requestsCh := make(chan BlockRequest, 10)
+	pool := newTestPool(t, requestsCh, make(chan peerError, 10),
+		WithRequesterWorkers(1), WithOnRequesterReassigned(func(height int64, from, to p2p.ID) {
+			reassigned <- to
+		}))
+
+	pool.SetPeerRange("a", 1, 1)
+	request := <-requestsCh
+	require.EqualValues(t, "a", request.PeerID)
+	pool.SetPeerRange("b", 1, 1)
+	pool.RemovePeer("a")
+
+	select {
+	case request := <-requestsCh:
+		assert.EqualValues(t, 1, request.Height)
+		assert.EqualValues(t, "b", request.PeerID)
+	case <-time.After(time.Second):
+		t.Fatal("expected the block to be requested from b")
+	}
+	assert.EqualValues(t, "b", <-reassigned)
+}
+
+// Compares goroutine counts and throughput of a goroutine per requester to
+// requester workers.
+func BenchmarkBlockPoolRequesterWorkers(b *testing.B) {
+	for _, workers := range []int{0, 8} {
+		workers := workers
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			requestsCh := make(chan BlockRequest, maxTotalRequesters)
+			pool, err := NewBlockPool(1, requestsCh, make(chan peerError, 1000),
+				WithRequesterWorkers(workers))
+			require.NoError(b, err)
+			require.NoError(b, pool.Start())
+			defer func() { require.NoError(b, pool.Stop()) }()
+
+			// the peers respond immediately, but blocks are only delivered
+			// once the requests have piled up, so all requesters wait at once.
+			pool.SetPeerRange("a", 1, int64(b.N)+1)
+			pool.SetPeerRange("b", 1, int64(b.N)+1)
+
+			maxGoroutines := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; {
+				if n := runtime.NumGoroutine(); n > maxGoroutines {
+					maxGoroutines = n
+				}
+				select {
+				case request := <-requestsCh:
+					block := &types.Block{Header: types.Header{Height: request.Height}}
+					pool.AddBlock(request.PeerID, block, 123)
+				default:
+				}
+				if first, second, _ := pool.PeekTwoBlocks(); first == nil || second == nil {
+					time.Sleep(10 * time.Microsecond)
+					continue
+				}
+				require.NoError(b, pool.PopRequest())
+				height, _, _ := pool.GetStatus()
+				pool.SetPeerRange("a", 1, height+int64(b.N))
+				pool.SetPeerRange("b", 1, height+int64(b.N))
+				i++
+			}
+			b.ReportMetric(float64(maxGoroutines), "goroutines")
+		})
+	}
+}
+
+func TestBlockPoolRequesterWorkersShutdown(t *testing.T) {
+	pool, err := NewBlockPool(1, make(chan BlockRequest), make(chan peerError),
+		WithRequesterWorkers(2), WithShutdownTimeout(time.Second))
+	require.NoError(t, err)
+	pool.SetLogger(log.TestingLogger())
+	require.NoError(t, pool.Start())
+
+	start := time.Now()
+	require.NoError(t, pool.Stop())
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Empty(t, pool.aliveRoutines())
+}